@@ -0,0 +1,123 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	e "forum/apis/error"
+	u "forum/apis/user"
+
+	"github.com/gorilla/websocket"
+)
+
+const maxAnnouncementLength = 1000 // characters
+
+// closeLocal closes the connections this instance holds for the given users.
+func (h *Hub) closeLocal(userIDs []int, reason string) {
+	h.Mutex.RLock()
+	var closing []*Client
+	for _, userID := range userIDs {
+		for client := range h.Clients[userID] {
+			closing = append(closing, client)
+		}
+	}
+	h.Mutex.RUnlock()
+
+	for _, client := range closing {
+		client.closeWithReason(websocket.ClosePolicyViolation, reason)
+	}
+}
+
+// DisconnectUser closes every socket the user has open, on all instances. The close code
+// stops the browser from reconnecting until the page is reloaded. With logout set the
+// user's sessions are deleted too, so they have to sign in again.
+func (h *Hub) DisconnectUser(userID int, logout bool) error {
+	if logout {
+		if _, err := h.DB.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+			return err
+		}
+	}
+	return h.Broker.Publish(Delivery{UserIDs: []int{userID}, Disconnect: "disconnected by an administrator"})
+}
+
+// Announce sends a notice from an administrator to everyone online.
+func (h *Hub) Announce(from int, content string) {
+	h.sendToAll(Frontend{Type: TypeAnnouncement, From: from, Content: content, Timestamp: time.Now().UTC()})
+}
+
+// requireAdmin answers the request itself and returns false unless it comes from an admin.
+func requireAdmin(hub *Hub, w http.ResponseWriter, r *http.Request, method string) (int, bool) {
+	if r.Method != method {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return 0, false
+	}
+	userID, loggedIn := u.ValidateSession(hub.DB, r)
+	if !loggedIn {
+		http.Error(w, "Unauthorized. Please log in.", http.StatusUnauthorized)
+		return 0, false
+	}
+	if !u.IsAdmin(hub.DB, userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return 0, false
+	}
+	return userID, true
+}
+
+// AdminStatsHandler serves GET /admin/chat/stats with a live snapshot of this hub instance.
+func AdminStatsHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(hub, w, r, http.MethodGet); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(hub.Stats())
+}
+
+// AdminDisconnectHandler serves POST /admin/chat/disconnect {"user_id", "logout"}.
+func AdminDisconnectHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	adminID, ok := requireAdmin(hub, w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	var req struct {
+		UserID int  `json:"user_id"`
+		Logout bool `json:"logout"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil || req.UserID <= 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := hub.DisconnectUser(req.UserID, req.Logout); err != nil {
+		fmt.Println(" Error disconnecting user:", err)
+		e.ErrorHandler(w, r, 500)
+		return
+	}
+	fmt.Printf("Admin %d disconnected user %d (logout: %t)\n", adminID, req.UserID, req.Logout)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminAnnounceHandler serves POST /admin/chat/announce {"content"}.
+func AdminAnnounceHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	adminID, ok := requireAdmin(hub, w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Content = strings.TrimSpace(req.Content)
+	if req.Content == "" || utf8.RuneCountInString(req.Content) > maxAnnouncementLength {
+		http.Error(w, fmt.Sprintf("Announcement must be 1 to %d characters", maxAnnouncementLength), http.StatusBadRequest)
+		return
+	}
+	hub.Announce(adminID, req.Content)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,254 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	u "forum/apis/user"
+
+	"github.com/google/uuid"
+)
+
+const MaxAttachmentSize = 10 << 20 // 10 MB
+
+// allowedAttachmentTypes maps the sniffed MIME types we accept to whether browsers may show them inline.
+var allowedAttachmentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": false,
+	"text/plain":      false,
+}
+
+var ErrAttachmentUnavailable = errors.New("attachment not found, not yours, or already sent")
+
+type Attachment struct {
+	ID       int64  `json:"id"`
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+	URL      string `json:"url"`
+}
+
+// uploadDir is where attachment files live; FORUM_UPLOAD_DIR overrides the default.
+func uploadDir() string {
+	if dir := os.Getenv("FORUM_UPLOAD_DIR"); dir != "" {
+		return dir
+	}
+	return "uploads"
+}
+
+func attachmentURL(id int64) string {
+	return "/attachments/" + strconv.FormatInt(id, 10)
+}
+
+// UploadAttachment stores a file from the "file" form field and returns its metadata.
+// The attachment stays private to the uploader until it is sent in a message.
+func UploadAttachment(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, loggedIn := u.ValidateSession(db, r)
+	if !loggedIn {
+		http.Error(w, "Unauthorized. Please log in.", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxAttachmentSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "A file of at most 10 MB is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > MaxAttachmentSize {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		return
+	}
+	mimeType, _, _ := strings.Cut(http.DetectContentType(sniff[:n]), ";")
+	if _, ok := allowedAttachmentTypes[mimeType]; !ok {
+		http.Error(w, "Unsupported file type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.MkdirAll(uploadDir(), 0o750); err != nil {
+		fmt.Println(" Error creating upload directory:", err)
+		http.Error(w, "Failed to store file", http.StatusInternalServerError)
+		return
+	}
+	storageName := uuid.New().String()
+	dst, err := os.OpenFile(filepath.Join(uploadDir(), storageName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		fmt.Println(" Error creating attachment file:", err)
+		http.Error(w, "Failed to store file", http.StatusInternalServerError)
+		return
+	}
+	size, err := io.Copy(dst, io.LimitReader(file, MaxAttachmentSize+1))
+	dst.Close()
+	if err != nil || size > MaxAttachmentSize {
+		os.Remove(filepath.Join(uploadDir(), storageName))
+		http.Error(w, "File too large or unreadable", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	filename := filepath.Base(header.Filename)
+	query := `INSERT INTO attachments (uploader_id, filename, mime_type, size, storage_name) VALUES (?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, userID, filename, mimeType, size, storageName)
+	if err != nil {
+		os.Remove(filepath.Join(uploadDir(), storageName))
+		fmt.Println(" Error saving attachment:", err)
+		http.Error(w, "Failed to store file", http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Attachment{ID: id, Filename: filename, MimeType: mimeType, Size: size, URL: attachmentURL(id)})
+}
+
+// ServeAttachment streams /attachments/{id} to its uploader or to either participant
+// of the message it was sent in.
+func ServeAttachment(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	userID, loggedIn := u.ValidateSession(db, r)
+	if !loggedIn {
+		http.Error(w, "Unauthorized. Please log in.", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/attachments/"), 10, 64)
+	if err != nil || id <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := `SELECT a.filename, a.mime_type, a.storage_name, a.created_at
+	          FROM attachments a
+	          LEFT JOIN messages m ON m.id = a.message_id
+	          WHERE a.id = ? AND (a.uploader_id = ? OR m.sender_id = ? OR m.receiver_id = ?)`
+	var filename, mimeType, storageName string
+	var createdAt time.Time
+	err = db.QueryRow(query, id, userID, userID, userID).Scan(&filename, &mimeType, &storageName, &createdAt)
+	if err != nil {
+		// Same answer whether it does not exist or is not ours, so IDs cannot be probed
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(uploadDir(), storageName))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	disposition := "attachment"
+	if allowedAttachmentTypes[mimeType] {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, filename))
+	w.Header().Set("Cache-Control", "private")
+	http.ServeContent(w, r, "", createdAt, file)
+}
+
+// claimAttachment links an uploaded file to the message that carries it. Only the uploader
+// can send an attachment, and only once.
+func claimAttachment(tx *sql.Tx, attachmentID, messageID int64, senderID int) error {
+	query := `UPDATE attachments SET message_id = ? WHERE id = ? AND uploader_id = ? AND message_id IS NULL`
+	result, err := tx.Exec(query, messageID, attachmentID, senderID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return ErrAttachmentUnavailable
+	}
+	return nil
+}
+
+// loadAttachments fills in the attachment metadata of messages that carry one.
+func loadAttachments(db *sql.DB, messages []Frontend) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	byMessage := make(map[int64]*Frontend, len(messages))
+	placeholders := make([]string, 0, len(messages))
+	args := make([]interface{}, 0, len(messages))
+	for i := range messages {
+		byMessage[messages[i].ID] = &messages[i]
+		placeholders = append(placeholders, "?")
+		args = append(args, messages[i].ID)
+	}
+
+	query := `SELECT id, message_id, filename, mime_type, size FROM attachments
+	          WHERE message_id IN (` + strings.Join(placeholders, ", ") + `)`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Attachment
+		var messageID int64
+		if err := rows.Scan(&a.ID, &messageID, &a.Filename, &a.MimeType, &a.Size); err != nil {
+			return err
+		}
+		a.URL = attachmentURL(a.ID)
+		if msg, ok := byMessage[messageID]; ok {
+			msg.AttachmentID = a.ID
+			msg.Attachment = &a
+		}
+	}
+	return rows.Err()
+}
+
+// deleteAttachments removes the files and rows attached to the given messages.
+func deleteAttachments(db *sql.DB, messageIDs ...int64) error {
+	for _, messageID := range messageIDs {
+		rows, err := db.Query(`SELECT storage_name FROM attachments WHERE message_id = ?`, messageID)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err == nil {
+				names = append(names, name)
+			}
+		}
+		rows.Close()
+
+		for _, name := range names {
+			if err := os.Remove(filepath.Join(uploadDir(), name)); err != nil && !os.IsNotExist(err) {
+				fmt.Println("Error removing attachment file:", err)
+			}
+		}
+		if _, err := db.Exec(`DELETE FROM attachments WHERE message_id = ?`, messageID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
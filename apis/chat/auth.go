@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const sessionCheckInterval = 30 * time.Second
+
+// allowedOriginsFromEnv reads FORUM_ALLOWED_ORIGINS, a comma-separated list of extra
+// origins such as "https://app.example.com" that may connect besides the forum's own.
+func allowedOriginsFromEnv() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("FORUM_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// checkOrigin rejects browser requests from other sites. Pages served by the forum itself
+// (Origin host == Host) are always allowed, whatever address it listens on; other origins
+// must be in the allowlist. Requests without an Origin header do not come from a browser
+// and are left to the session check.
+func (h *Hub) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, allowed := range h.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionValid reports whether the session token still exists and has not expired.
+func sessionValid(db *sql.DB, token string) bool {
+	var expiresAt time.Time
+	err := db.QueryRow(`SELECT expires_at FROM sessions WHERE token = ?`, token).Scan(&expiresAt)
+	return err == nil && time.Now().Before(expiresAt)
+}
+
+// closeWithReason tells the browser why the connection is going away and closes it;
+// the client is then unregistered. Only the first call has any effect.
+func (c *Client) closeWithReason(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.transport.close(code, reason)
+	})
+}
+
+// CloseSession disconnects every socket opened with the given session token, e.g. on logout.
+func (h *Hub) CloseSession(token string) {
+	h.Mutex.RLock()
+	var closing []*Client
+	for _, devices := range h.Clients {
+		for client := range devices {
+			if client.Token == token {
+				closing = append(closing, client)
+			}
+		}
+	}
+	h.Mutex.RUnlock()
+
+	for _, client := range closing {
+		client.closeWithReason(websocket.ClosePolicyViolation, "logged out")
+	}
+}
+
+// watchSessions periodically drops sockets whose session has expired or been removed.
+func (h *Hub) watchSessions() {
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.limits.prune(time.Now())
+
+		h.Mutex.RLock()
+		var clients []*Client
+		for _, devices := range h.Clients {
+			for client := range devices {
+				clients = append(clients, client)
+			}
+		}
+		h.Mutex.RUnlock()
+
+		valid := make(map[string]bool)
+		for _, client := range clients {
+			ok, checked := valid[client.Token]
+			if !checked {
+				ok = sessionValid(h.DB, client.Token)
+				valid[client.Token] = ok
+			}
+			if !ok {
+				client.closeWithReason(websocket.ClosePolicyViolation, "session expired")
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	e "forum/apis/error"
+	u "forum/apis/user"
+)
+
+type ListedUser struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+func BlockUser(db *sql.DB, blockerID, blockedID int) error {
+	_, err := db.Exec(`INSERT OR IGNORE INTO user_blocks (blocker_id, blocked_id) VALUES (?, ?)`, blockerID, blockedID)
+	return err
+}
+
+func UnblockUser(db *sql.DB, blockerID, blockedID int) error {
+	_, err := db.Exec(`DELETE FROM user_blocks WHERE blocker_id = ? AND blocked_id = ?`, blockerID, blockedID)
+	return err
+}
+
+// IsBlocked reports whether either user has blocked the other.
+func IsBlocked(db *sql.DB, a, b int) (bool, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM user_blocks
+	          WHERE (blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)`
+	err := db.QueryRow(query, a, b, b, a).Scan(&count)
+	return count > 0, err
+}
+
+// HiddenUserIDs returns everyone the user has blocked or been blocked by.
+func HiddenUserIDs(db *sql.DB, userID int) (map[int]bool, error) {
+	query := `SELECT blocked_id FROM user_blocks WHERE blocker_id = ?
+	          UNION
+	          SELECT blocker_id FROM user_blocks WHERE blocked_id = ?`
+	rows, err := db.Query(query, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hidden := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		hidden[id] = true
+	}
+	return hidden, rows.Err()
+}
+
+func MuteConversation(db *sql.DB, userID, peerID int) error {
+	_, err := db.Exec(`INSERT OR IGNORE INTO conversation_mutes (user_id, peer_id) VALUES (?, ?)`, userID, peerID)
+	return err
+}
+
+func UnmuteConversation(db *sql.DB, userID, peerID int) error {
+	_, err := db.Exec(`DELETE FROM conversation_mutes WHERE user_id = ? AND peer_id = ?`, userID, peerID)
+	return err
+}
+
+// IsMuted reports whether the user muted their conversation with peerID.
+func IsMuted(db *sql.DB, userID, peerID int) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM conversation_mutes WHERE user_id = ? AND peer_id = ?`, userID, peerID).Scan(&count)
+	return count > 0, err
+}
+
+func listUsers(db *sql.DB, query string, userID int) ([]ListedUser, error) {
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []ListedUser{}
+	for rows.Next() {
+		var b ListedUser
+		if err := rows.Scan(&b.UserID, &b.Username); err != nil {
+			return nil, err
+		}
+		users = append(users, b)
+	}
+	return users, rows.Err()
+}
+
+// BlocksHandler serves /blocks: GET lists blocked users, POST {"user_id"} blocks, DELETE ?user_id= unblocks.
+func BlocksHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	listQuery := `SELECT u.id, u.username FROM user_blocks b JOIN users u ON u.id = b.blocked_id
+	              WHERE b.blocker_id = ? ORDER BY u.username`
+	userListHandler(db, w, r, listQuery, BlockUser, UnblockUser)
+}
+
+// MutesHandler serves /mutes the same way for muted conversations.
+func MutesHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	listQuery := `SELECT u.id, u.username FROM conversation_mutes m JOIN users u ON u.id = m.peer_id
+	              WHERE m.user_id = ? ORDER BY u.username`
+	userListHandler(db, w, r, listQuery, MuteConversation, UnmuteConversation)
+}
+
+func userListHandler(db *sql.DB, w http.ResponseWriter, r *http.Request, listQuery string, add, remove func(*sql.DB, int, int) error) {
+	userID, loggedIn := u.ValidateSession(db, r)
+	if !loggedIn {
+		http.Error(w, "Unauthorized. Please log in.", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			UserID int `json:"user_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID <= 0 || req.UserID == userID {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		if err := add(db, userID, req.UserID); err != nil {
+			fmt.Println(" Error updating user list:", err)
+			e.ErrorHandler(w, r, 500)
+			return
+		}
+	case http.MethodDelete:
+		otherID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+		if err != nil || otherID <= 0 {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		if err := remove(db, userID, otherID); err != nil {
+			fmt.Println(" Error updating user list:", err)
+			e.ErrorHandler(w, r, 500)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	users, err := listUsers(db, listQuery, userID)
+	if err != nil {
+		e.ErrorHandler(w, r, 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
@@ -0,0 +1,198 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	outboxPollInterval = 100 * time.Millisecond
+	outboxBatchSize    = 500
+	outboxRetention    = time.Minute // rows older than this are pruned; every instance has read them by then
+)
+
+// Delivery is one fan-out request: a frame for the connections of some users, or of everyone.
+// With Disconnect set it instead closes the users' connections, giving that as the reason.
+// With Frame set it carries a frame posted to /chat/send on one instance to the instance
+// holding the SSE connection ConnID.
+type Delivery struct {
+	UserIDs    []int           `json:"user_ids,omitempty"`
+	Everyone   bool            `json:"everyone,omitempty"`
+	Msg        Frontend        `json:"msg"`
+	Disconnect string          `json:"disconnect,omitempty"`
+	ConnID     string          `json:"conn_id,omitempty"`
+	Frame      json.RawMessage `json:"frame,omitempty"`
+}
+
+// Broker carries deliveries between hub instances. Every instance subscribes, and each
+// one hands the frames to the connections it holds. Publish must also deliver to the
+// publishing instance, keeping Frontend.origin intact so senders' echoes are filtered.
+type Broker interface {
+	Publish(d Delivery) error
+	Subscribe(handler func(Delivery))
+	Close() error
+}
+
+// NewBrokerFromEnv picks the broker named by FORUM_CHAT_BROKER: "memory" (the default)
+// for a single process, or "sqlite" to share chat between processes using the same database.
+func NewBrokerFromEnv(db *sql.DB) (Broker, error) {
+	switch kind := os.Getenv("FORUM_CHAT_BROKER"); kind {
+	case "", "memory":
+		return NewInMemoryBroker(), nil
+	case "sqlite":
+		return NewSQLiteBroker(db)
+	default:
+		return nil, fmt.Errorf("unknown FORUM_CHAT_BROKER %q", kind)
+	}
+}
+
+// InMemoryBroker delivers straight to the local hub.
+type InMemoryBroker struct {
+	mu       sync.RWMutex
+	handlers []func(Delivery)
+}
+
+func NewInMemoryBroker() *InMemoryBroker {
+	return &InMemoryBroker{}
+}
+
+func (b *InMemoryBroker) Publish(d Delivery) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(d)
+	}
+	return nil
+}
+
+func (b *InMemoryBroker) Subscribe(handler func(Delivery)) {
+	b.mu.Lock()
+	b.handlers = append(b.handlers, handler)
+	b.mu.Unlock()
+}
+
+func (b *InMemoryBroker) Close() error {
+	return nil
+}
+
+// SQLiteBroker shares deliveries between processes through the chat_outbox table.
+// Local subscribers get each delivery immediately; other instances pick it up on
+// their next poll, skipping the rows they wrote themselves.
+type SQLiteBroker struct {
+	*InMemoryBroker
+	db         *sql.DB
+	instanceID string
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func NewSQLiteBroker(db *sql.DB) (*SQLiteBroker, error) {
+	var lastID int64
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM chat_outbox`).Scan(&lastID); err != nil {
+		return nil, err
+	}
+	b := &SQLiteBroker{
+		InMemoryBroker: NewInMemoryBroker(),
+		db:             db,
+		instanceID:     uuid.New().String(),
+		done:           make(chan struct{}),
+	}
+	go b.poll(lastID)
+	return b, nil
+}
+
+func (b *SQLiteBroker) Publish(d Delivery) error {
+	b.InMemoryBroker.Publish(d)
+
+	payload, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO chat_outbox (instance_id, payload, created_at) VALUES (?, ?, ?)`
+	_, err = b.db.Exec(query, b.instanceID, payload, time.Now().UTC())
+	return err
+}
+
+func (b *SQLiteBroker) Close() error {
+	b.closeOnce.Do(func() { close(b.done) })
+	return nil
+}
+
+// poll reads rows written by other instances after lastID, and prunes old rows now and then.
+func (b *SQLiteBroker) poll(lastID int64) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	lastPrune := time.Now()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			n, err := b.readBatch(&lastID)
+			if err != nil {
+				fmt.Println("Error reading chat outbox:", err)
+				break
+			}
+			if n < outboxBatchSize {
+				break
+			}
+		}
+
+		if time.Since(lastPrune) > outboxRetention {
+			cutoff := time.Now().UTC().Add(-outboxRetention)
+			if _, err := b.db.Exec(`DELETE FROM chat_outbox WHERE created_at < ?`, cutoff); err != nil {
+				fmt.Println("Error pruning chat outbox:", err)
+			}
+			lastPrune = time.Now()
+		}
+	}
+}
+
+func (b *SQLiteBroker) readBatch(lastID *int64) (int, error) {
+	query := `SELECT id, instance_id, payload FROM chat_outbox WHERE id > ? ORDER BY id LIMIT ?`
+	rows, err := b.db.Query(query, *lastID, outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var deliveries []Delivery
+	n := 0
+	for rows.Next() {
+		var id int64
+		var instanceID string
+		var payload []byte
+		if err := rows.Scan(&id, &instanceID, &payload); err != nil {
+			rows.Close()
+			return n, err
+		}
+		n++
+		*lastID = id
+		if instanceID == b.instanceID {
+			continue
+		}
+		var d Delivery
+		if err := json.Unmarshal(payload, &d); err != nil {
+			fmt.Println("Error decoding chat outbox row:", err)
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	err = rows.Err()
+	rows.Close()
+
+	// Handlers may write to the database, so the rows are closed first
+	for _, d := range deliveries {
+		b.InMemoryBroker.Publish(d)
+	}
+	return n, err
+}
@@ -3,17 +3,24 @@ package chat
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
 	"sync"
 	"time"
 
+	u "forum/apis/user"
+
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	_ "modernc.org/sqlite"
 )
 
 type Frontend struct {
+	V         int       `json:"v,omitempty"`         // envelope version, see ProtocolVersion
+	ClientID  string    `json:"client_id,omitempty"` // browser-generated ID echoed in acks and errors
+	ConnID    string    `json:"conn_id,omitempty"`   // hello: the ID an SSE client posts its frames with
+	ID        int64     `json:"id,omitempty"`
 	From      int       `json:"from"`
 	To        int       `json:"to"`
 	Content   string    `json:"content"`
@@ -21,73 +28,343 @@ type Frontend struct {
 	Type      string    `json:"type"`
 	PostId    int       `json:"post_id"`
 	CommentId int       `json:"comment_id"`
-	isLike    bool      `json:"is_like"`
+	IsLike    bool      `json:"is_like"`
+	RoomID    int       `json:"room_id,omitempty"`
+	Members   []int     `json:"members,omitempty"`
+
+	DeliveredAt  *time.Time      `json:"delivered_at,omitempty"`
+	ReadAt       *time.Time      `json:"read_at,omitempty"`
+	EditedAt     *time.Time      `json:"edited_at,omitempty"`
+	DeletedAt    *time.Time      `json:"deleted_at,omitempty"`
+	ReplyTo      int64           `json:"reply_to,omitempty"`      // direct message this one answers
+	Emoji        string          `json:"emoji,omitempty"`         // react and unreact frames
+	Reactions    []ReactionCount `json:"reactions,omitempty"`     // totals per emoji, filled in by the server
+	ReplyPreview *ReplyPreview   `json:"reply_preview,omitempty"` // filled in by the server
+	ExpiresAt    *time.Time      `json:"expires_at,omitempty"`    // set when the conversation has a disappearing-message timer
+	TTL          int64           `json:"ttl,omitempty"`           // timer_changed: new timer in seconds, 0 when turned off
+	IDs          []int64         `json:"ids,omitempty"`           // messages_expired: messages to drop
+
+	Conversation *Conversation      `json:"conversation,omitempty"`
+	Counts       *InteractionCounts `json:"counts,omitempty"`
+
+	Silent       bool        `json:"silent,omitempty"` // receiver muted the conversation; no notification
+	AttachmentID int64       `json:"attachment_id,omitempty"`
+	Attachment   *Attachment `json:"attachment,omitempty"`
+
+	Encryption // end-to-end encrypted DMs carry ciphertext in Content
+
+	Error *FrameError `json:"error,omitempty"`
+
+	origin *Client // connection the frame arrived on; skipped when echoing to the sender's other devices
+	echo   bool    // deliver to origin too, for frames the server rewrote (slash command output)
+
+	closeCode   int // set on a connection's last frame: writePump closes it once the frame is written
+	closeReason string
 }
 
+const (
+	writeWait      = 10 * time.Second    // time allowed to write one frame
+	pongWait       = 60 * time.Second    // time allowed between pongs from the browser
+	pingPeriod     = (pongWait * 9) / 10 // must be shorter than pongWait
+	maxMessageSize = 64 << 10            // largest frame accepted from a browser
+	sendQueueSize  = 256                 // frames queued per connection before it counts as stalled
+)
+
 type Client struct {
 	UserID int
-	Conn   *websocket.Conn
-	Send   chan Frontend
+	Token  string          // session token the socket was opened with
+	Conn   *websocket.Conn // nil for SSE clients
+	Send   chan Frontend   // bounded queue drained by writePump; closed on unregister
+
+	LastSeen     int64 // newest direct message ID the client already has
+	LastSeenRoom int64 // newest room message ID the client already has
+
+	hub         *Hub
+	transport   transport // how frames reach the browser
+	connID      string    // set for SSE clients, which send frames over POST /chat/send
+	connectedAt time.Time
+	closeOnce   sync.Once
+	banOnce     sync.Once               // guards the final frame queued when the client is banned
+	dropOnce    sync.Once               // guards closing a client whose queue overflowed
+	buckets     [numFrameClasses]bucket // per-connection flood budgets, charged by readPump and SendHandler
 }
 
 type Hub struct {
-	Clients      map[int]*Client
+	Clients      map[int]map[*Client]bool // every open connection, grouped by user
 	Register     chan *Client
 	Unregister   chan *Client
 	Broadcast    chan Frontend
-	MessageStore map[string][]Frontend // key: "user1-user2"
+	MessageStore map[string][]Frontend // key: "user1-user2" or "room-id"
 	Mutex        sync.RWMutex
 	DB           *sql.DB
-}
+	Broker       Broker // fans frames out to the connections on every instance
+	limits       *rateLimiter
+	meters       *hubMeters
+	Retention    time.Duration // maximum age of any message; zero keeps them forever
+	commands     *commandRegistry
+	instanceID   string // identifies this hub in the shared presence tables
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	AllowedOrigins []string // other sites' origins allowed to connect; the forum's own always is
 }
 
-func NewHub(db *sql.DB) *Hub {
-	return &Hub{
-		Clients:      make(map[int]*Client),
+func NewHub(db *sql.DB, broker Broker) *Hub {
+	h := &Hub{
+		Clients:      make(map[int]map[*Client]bool),
 		Register:     make(chan *Client),
 		Unregister:   make(chan *Client),
 		Broadcast:    make(chan Frontend),
 		MessageStore: make(map[string][]Frontend),
 		DB:           db,
+		Broker:       broker,
+		limits:       newRateLimiterFromEnv(),
+		meters:       &hubMeters{startedAt: time.Now().UTC()},
+		Retention:    retentionFromEnv(),
+		instanceID:   uuid.New().String(),
+		commands:     &commandRegistry{commands: make(map[string]Command), reminders: make(map[int]int)},
+
+		AllowedOrigins: allowedOriginsFromEnv(),
 	}
+	h.registerBuiltinCommands()
+	broker.Subscribe(h.deliverLocal)
+	return h
 }
 
 func (h *Hub) Run() {
+	// Registered before any client, so this instance's connections count from the start
+	if err := h.heartbeat(); err != nil {
+		fmt.Println("Error updating chat heartbeat:", err)
+	}
+	go h.watchSessions()
+	go h.purgeExpired()
+	go h.watchPresence()
+
 	for {
 		select {
 		case client := <-h.Register:
 			h.Mutex.Lock()
-			h.Clients[client.UserID] = client
+			firstConnection := h.Clients[client.UserID] == nil
+			if firstConnection {
+				h.Clients[client.UserID] = make(map[*Client]bool)
+			}
+			h.Clients[client.UserID][client] = true
 			h.Mutex.Unlock()
+			// Other instances may hold connections of this user too
+			first, err := h.presenceConnect(client.UserID)
+			if err != nil {
+				fmt.Println("Error recording presence:", err)
+				first = firstConnection
+			}
+			if first {
+				h.announcePresence(client.UserID, true)
+			}
 		case client := <-h.Unregister:
 			h.Mutex.Lock()
-			delete(h.Clients, client.UserID)
+			registered, lastConnection := false, false
+			if devices, ok := h.Clients[client.UserID]; ok && devices[client] {
+				registered = true
+				delete(devices, client)
+				close(client.Send)
+				if len(devices) == 0 {
+					delete(h.Clients, client.UserID)
+					lastConnection = true
+				}
+			}
 			h.Mutex.Unlock()
+			if !registered {
+				continue
+			}
+			last, err := h.presenceDisconnect(client.UserID)
+			if err != nil {
+				fmt.Println("Error recording presence:", err)
+				last = lastConnection
+			}
+			if last {
+				h.announcePresence(client.UserID, false)
+			}
 		case msg := <-h.Broadcast:
-			key := chatKey(msg.From, msg.To)
-			h.Mutex.Lock()
-			h.MessageStore[key] = append(h.MessageStore[key], msg)
-			h.Mutex.Unlock()
-			_ = h.saveMessageToDB(msg)
-			if toClient, ok := h.Clients[msg.To]; ok {
-				toClient.Send <- msg
+			if msg.RoomID > 0 {
+				msg.Type = "room_message"
+				h.broadcastToRoom(msg)
+				continue
 			}
+			h.deliverDirect(msg)
+		}
+	}
+}
+
+// deliverDirect stores a direct message and sends it to both participants' devices.
+// Messages between users where either has blocked the other are rejected; muted
+// conversations still get the message, but flagged silent and without a list update.
+func (h *Hub) deliverDirect(msg Frontend) {
+	blocked, err := IsBlocked(h.DB, msg.From, msg.To)
+	if err != nil {
+		fmt.Println("Error checking blocks:", err)
+		return
+	}
+	if blocked {
+		if msg.origin != nil {
+			msg.origin.sendError(msg, ErrCodeForbidden, "You cannot message this user.")
+		}
+		return
+	}
+
+	// A retry of a message we already have is acknowledged again but not redelivered
+	id, createdAt, duplicate, err := findByClientID(h.DB, "messages", msg.From, msg.ClientID)
+	if err != nil {
+		fmt.Println("Error checking for a resent message:", err)
+	}
+	if duplicate {
+		if msg.origin != nil {
+			msg.origin.ack(msg.ClientID, Frontend{ID: id, From: msg.From, To: msg.To}, createdAt)
+		}
+		return
+	}
+
+	if err := checkEncryption(h.DB, msg); err != nil {
+		if msg.origin != nil {
+			msg.origin.sendError(msg, ErrCodeInvalid, encryptionErrorMessage(err))
+		}
+		return
+	}
+
+	msg.ReplyPreview, err = replyPreview(h.DB, msg)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidReply) {
+			fmt.Println("Error loading replied-to message:", err)
 		}
+		if msg.origin != nil {
+			msg.origin.sendError(msg, ErrCodeInvalid, "That message cannot be replied to.")
+		}
+		return
 	}
+
+	h.stampExpiry(&msg)
+	id, err = h.saveMessageToDB(msg)
+	if errors.Is(err, ErrAttachmentUnavailable) && msg.origin != nil {
+		msg.origin.sendError(msg, ErrCodeInvalid, "That attachment cannot be sent.")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error saving message:", err)
+		if msg.origin != nil {
+			msg.origin.sendError(msg, ErrCodeInternal, "The message could not be saved.")
+		}
+		return
+	}
+	msg.ID = id
+	h.meters.messages.mark(time.Now())
+	if msg.origin != nil {
+		msg.origin.ack(msg.ClientID, msg, msg.Timestamp)
+	}
+	if msg.AttachmentID > 0 {
+		saved := []Frontend{msg}
+		if err := loadAttachments(h.DB, saved); err != nil {
+			fmt.Println("Error loading attachment:", err)
+		}
+		msg = saved[0]
+	}
+	h.markDeliveredIfOnline(&msg)
+
+	key := chatKey(msg.From, msg.To)
+	h.Mutex.Lock()
+	h.MessageStore[key] = append(h.MessageStore[key], msg)
+	h.Mutex.Unlock()
+
+	muted, err := IsMuted(h.DB, msg.To, msg.From)
+	if err != nil {
+		fmt.Println("Error checking mutes:", err)
+	}
+	received := msg
+	received.Silent = muted
+	h.sendToUser(msg.To, received)
+	if msg.From != msg.To {
+		h.sendToUser(msg.From, msg)
+		h.pushConversationUpdate(msg.From, msg.To)
+	}
+	if !muted {
+		h.pushConversationUpdate(msg.To, msg.From)
+	}
+}
+
+// sendToUser delivers msg to every open connection of the user, except the one it came from.
+func (h *Hub) sendToUser(userID int, msg Frontend) {
+	h.publish(Delivery{UserIDs: []int{userID}, Msg: msg})
+}
+
+// sendToAll delivers msg to every open connection, on this instance and the others.
+func (h *Hub) sendToAll(msg Frontend) {
+	h.publish(Delivery{Everyone: true, Msg: msg})
 }
 
-func (h *Hub) GetOnlineUserIDs() []int {
+func (h *Hub) publish(d Delivery) {
+	if err := h.Broker.Publish(d); err != nil {
+		fmt.Println("Error publishing chat frame:", err)
+	}
+}
+
+// deliverLocal is the broker subscription: it queues a delivery on this instance's connections.
+func (h *Hub) deliverLocal(d Delivery) {
+	if d.Disconnect != "" {
+		h.closeLocal(d.UserIDs, d.Disconnect)
+		return
+	}
+	if d.Frame != nil {
+		for _, userID := range d.UserIDs {
+			if client := h.findConnection(userID, d.ConnID); client != nil {
+				h.receive(client, d.Frame)
+			}
+		}
+		return
+	}
+	msg := d.Msg
+	receiverHere := false
+
+	h.Mutex.RLock()
+	if d.Everyone {
+		for _, devices := range h.Clients {
+			for client := range devices {
+				client.enqueue(msg)
+			}
+		}
+	}
+	for _, userID := range d.UserIDs {
+		for client := range h.Clients[userID] {
+			if client != msg.origin || msg.echo {
+				client.enqueue(msg)
+				receiverHere = receiverHere || userID == msg.To
+			}
+		}
+	}
+	h.Mutex.RUnlock()
+
+	// The sender's instance could not see the receiver online; this one delivered it
+	if receiverHere && msg.Type == "message" && msg.ID > 0 && msg.DeliveredAt == nil {
+		h.acknowledgeReplayed(&msg)
+	}
+}
+
+// sendToClient delivers msg to a single connection if it is still registered.
+func (h *Hub) sendToClient(client *Client, msg Frontend) {
 	h.Mutex.RLock()
 	defer h.Mutex.RUnlock()
+	if h.Clients[client.UserID][client] {
+		client.enqueue(msg)
+	}
+}
 
-	var userIDs []int
-	for id := range h.Clients {
-		userIDs = append(userIDs, id)
+// enqueue queues msg without blocking. A connection whose queue is full is not keeping up,
+// so it is disconnected rather than allowed to stall the hub; the browser reconnects and
+// replays what it missed. Callers hold hub.Mutex, which keeps Send open while we write to it.
+func (c *Client) enqueue(msg Frontend) {
+	select {
+	case c.Send <- msg:
+	default:
+		// A fan-out may hit the full queue many times; count and close the client once
+		c.dropOnce.Do(func() {
+			c.hub.meters.dropped.mark(time.Now())
+			go c.closeWithReason(websocket.CloseTryAgainLater, "too slow")
+		})
 	}
-	return userIDs
 }
 
 func chatKey(a, b int) string {
@@ -98,23 +375,41 @@ func chatKey(a, b int) string {
 }
 
 func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	userIDStr := r.URL.Query().Get("user_id")
-	userID, err := strconv.Atoi(userIDStr)
-	if err != nil || userID <= 0 {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+	userID, loggedIn := u.ValidateSession(hub.DB, r)
+	if !loggedIn {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if hub.rejectIfBanned(w, userID) {
 		return
 	}
 
+	upgrader := websocket.Upgrader{CheckOrigin: hub.checkOrigin}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		fmt.Println("WebSocket Upgrade Error:", err)
 		return
 	}
 
-	client := &Client{UserID: userID, Conn: conn, Send: make(chan Frontend)}
+	client := &Client{
+		UserID:       userID,
+		Token:        cookie.Value,
+		Conn:         conn,
+		Send:         make(chan Frontend, sendQueueSize),
+		LastSeen:     parseLastSeen(r.URL.Query().Get("last_seen")),
+		LastSeenRoom: parseLastSeen(r.URL.Query().Get("last_seen_room")),
+		hub:          hub,
+		transport:    wsTransport{conn},
+		connectedAt:  time.Now().UTC(),
+	}
 	hub.Register <- client
 
-	go client.writePump()
+	go client.writePump(hub)
 	go client.readPump(hub)
 }
 
@@ -124,52 +419,132 @@ func (c *Client) readPump(hub *Hub) {
 		c.Conn.Close()
 	}()
 
+	c.Conn.SetReadLimit(maxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
 	for {
 		_, data, err := c.Conn.ReadMessage()
 		if err != nil {
 			break
 		}
+		hub.receive(c, data)
+	}
+}
 
-		var msg Frontend
-		if err := json.Unmarshal(data, &msg); err != nil {
-			continue
-		}
+// receive handles one frame from a browser, whichever transport it came over.
+func (h *Hub) receive(c *Client, data []byte) {
+	h.meters.framesIn.mark(time.Now())
 
-		// Handle typing signal separately
-		if msg.Type == "typing" {
-			hub.Mutex.RLock()
-			if toClient, ok := hub.Clients[msg.To]; ok {
-				toClient.Send <- msg
-			}
-			hub.Mutex.RUnlock()
-			continue
+	var msg Frontend
+	err := json.Unmarshal(data, &msg)
+	if !h.checkRate(c, msg) {
+		return
+	}
+	if err != nil {
+		c.sendError(Frontend{}, ErrCodeMalformed, "Frame is not a valid message envelope.")
+		return
+	}
+	h.dispatch(c, msg)
+}
+
+// writePump is the only goroutine that writes data frames to the connection. It stops on
+// the first failed write; closing the connection then makes the client unregister.
+func (c *Client) writePump(hub *Hub) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.closeWithReason(websocket.CloseNormalClosure, "")
+	}()
+
+	// Live messages are held back while the backlog is written, so nothing arrives
+	// out of order; copies of replayed messages are dropped.
+	lastDM, lastRoom, held, err := c.replayMissed(hub)
+	if err != nil {
+		if err != errQueueClosed {
+			fmt.Println("Error replaying missed messages:", err)
 		}
+		return
+	}
+	// writeLive reports false once the connection is done
+	writeLive := func(msg Frontend) bool {
+		if alreadyReplayed(msg, lastDM, lastRoom) {
+			return true
+		}
+		if err := c.write(msg); err != nil {
+			return false
+		}
+		if msg.closeCode != 0 {
+			c.closeWithReason(msg.closeCode, msg.closeReason)
+			return false
+		}
+		return true
+	}
+	for _, msg := range held {
+		if !writeLive(msg) {
+			return
+		}
+	}
 
-		if msg.Type == "new_post" || msg.Type == "new_comment" || msg.Type == "new_postLike" || msg.Type == "new_commentLike" {
-			hub.Mutex.RLock()
-			for _, client := range hub.Clients {
-				// Optional: skip sender if you want
-				client.Send <- msg
+	for {
+		select {
+		case msg, ok := <-c.Send:
+			if !ok {
+				return // The hub closed the queue
+			}
+			if !writeLive(msg) {
+				return
+			}
+		case <-ticker.C:
+			if err := c.transport.ping(); err != nil {
+				return
 			}
-			hub.Mutex.RUnlock()
-			continue
 		}
-
-		// Normal message: timestamp and broadcast
-		msg.Timestamp = time.Now()
-		hub.Broadcast <- msg
 	}
 }
 
-func (c *Client) writePump() {
-	for msg := range c.Send {
-		data, _ := json.Marshal(msg)
-		c.Conn.WriteMessage(websocket.TextMessage, data)
+// write sends one frame, giving up if the browser does not take it within writeWait.
+func (c *Client) write(msg Frontend) error {
+	msg.V = ProtocolVersion
+	data, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Println("Error encoding frame:", err)
+		return nil
+	}
+	if err := c.transport.writeFrame(data); err != nil {
+		return err
 	}
+	c.hub.meters.framesOut.mark(time.Now())
+	return nil
 }
 
-func (h *Hub) saveMessageToDB(msg Frontend) error {
-	query := `INSERT INTO messages (sender_id, receiver_id, content, created_at) VALUES (?, ?, ?, ?)`
-	_, err := h.DB.Exec(query, msg.From, msg.To, msg.Content, msg.Timestamp)
-	return err
+func (h *Hub) saveMessageToDB(msg Frontend) (int64, error) {
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO messages (sender_id, receiver_id, content, created_at, client_id,
+	                                encrypted, sender_key_id, recipient_key_id, nonce, expires_at, reply_to_id)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, msg.From, msg.To, msg.Content, msg.Timestamp, nullableClientID(msg.ClientID),
+		msg.Encrypted, nullString(msg.SenderKeyID), nullString(msg.RecipientKeyID), nullString(msg.Nonce), msg.ExpiresAt,
+		sql.NullInt64{Int64: msg.ReplyTo, Valid: msg.ReplyTo > 0})
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if msg.AttachmentID > 0 {
+		if err := claimAttachment(tx, msg.AttachmentID, id, msg.From); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
 }
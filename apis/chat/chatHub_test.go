@@ -0,0 +1,113 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialChat opens a websocket to the hub as the user with the given session token.
+func dialChat(t *testing.T, hub *Hub, token, query string) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { ServeWs(hub, w, r) }))
+	t.Cleanup(srv.Close)
+
+	header := http.Header{}
+	header.Set("Cookie", "session_token="+token)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+query, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// nextFrame returns the next frame of one of the given types, skipping presence and the like.
+func nextFrame(t *testing.T, conn *websocket.Conn, types ...string) Frontend {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %v: %v", types, err)
+		}
+		var msg Frontend
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		for _, frameType := range types {
+			if msg.Type == frameType {
+				return msg
+			}
+		}
+	}
+}
+
+// A frame resent with the same client_id, as browsers do after a reconnect, is stored once
+// and acknowledged with the original message ID.
+func TestResentMessageIsStoredOnce(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub(t, db, NewInMemoryBroker())
+	sender := dialChat(t, hub, "tok1", "")
+	receiver := dialChat(t, hub, "tok2", "")
+	nextFrame(t, receiver, "user_online") // the receiver is registered
+
+	frame := Frontend{V: ProtocolVersion, Type: TypeMessage, To: 2, Content: "hello", ClientID: "client-1"}
+	var acks []Frontend
+	for i := 0; i < 2; i++ {
+		if err := sender.WriteJSON(frame); err != nil {
+			t.Fatal(err)
+		}
+		acks = append(acks, nextFrame(t, sender, TypeAck, TypeError))
+	}
+	for _, ack := range acks {
+		if ack.Type != TypeAck || ack.ClientID != "client-1" || ack.ID != acks[0].ID || ack.ID == 0 {
+			t.Fatalf("acks = %+v, want two acks for the same message", acks)
+		}
+	}
+
+	var stored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages WHERE client_id = 'client-1'`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Errorf("stored %d copies, want 1", stored)
+	}
+	if got := nextFrame(t, receiver, TypeMessage); got.ID != acks[0].ID || got.Content != "hello" {
+		t.Errorf("receiver got %+v", got)
+	}
+}
+
+// A client reconnecting with last_seen gets the messages it missed, in order, then "resumed".
+func TestReplayMissedMessages(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub(t, db, NewInMemoryBroker())
+	for _, content := range []string{"one", "two", "three"} {
+		_, err := db.Exec(`INSERT INTO messages (sender_id, receiver_id, content, created_at) VALUES (1, 2, ?, ?)`,
+			content, time.Now().UTC())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn := dialChat(t, hub, "tok2", "?last_seen=1")
+	for _, want := range []string{"two", "three"} {
+		if got := nextFrame(t, conn, TypeMessage, "resumed"); got.Type != TypeMessage || got.Content != want {
+			t.Fatalf("got %s %q, want message %q", got.Type, got.Content, want)
+		}
+	}
+	nextFrame(t, conn, "resumed")
+
+	var undelivered int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages WHERE id > 1 AND delivered_at IS NULL`).Scan(&undelivered); err != nil {
+		t.Fatal(err)
+	}
+	if undelivered != 0 {
+		t.Errorf("%d replayed messages not marked delivered", undelivered)
+	}
+}
@@ -0,0 +1,275 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"forum/database"
+)
+
+const (
+	minReminder         = 10 * time.Second
+	maxReminder         = 7 * 24 * time.Hour
+	maxPendingReminders = 20 // per user
+	maxPostTitleLength  = 200
+)
+
+var commandName = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// Command is a slash command typed into a chat, e.g. "/shrug". Run gets the rest of the
+// line in ctx.Args; an error it returns is shown privately to the user who typed it.
+type Command struct {
+	Name        string // without the slash, lower case
+	Usage       string // e.g. "/remind <duration> <text>"
+	Description string
+	Public      bool // posts what the user typed where others see it; refused in encrypted DMs
+	Run         func(ctx *CommandContext) error
+}
+
+// CommandContext is what a command knows about the line that invoked it and how it answers.
+type CommandContext struct {
+	Hub     *Hub
+	UserID  int      // who typed the command
+	Args    string   // everything after the command name, trimmed
+	Message Frontend // the frame as sent; To or RoomID says which conversation it was typed in
+
+	published bool
+}
+
+// ReplyPrivate shows text to the user who typed the command, on all of their devices.
+// Nothing is stored.
+func (ctx *CommandContext) ReplyPrivate(text string) {
+	ctx.Hub.sendToUser(ctx.UserID, Frontend{Type: TypeSystem, To: ctx.UserID, Content: text, Timestamp: time.Now().UTC()})
+}
+
+// ReplyPublic posts text into the conversation as a message from the user, stored and
+// delivered like any other, including to the device it was typed on.
+func (ctx *CommandContext) ReplyPublic(text string) {
+	msg := ctx.Message
+	msg.Content = text
+	msg.Timestamp = time.Now().UTC()
+	msg.echo = true
+	if ctx.published {
+		msg.ClientID = "" // only the first reply answers the browser's frame
+	}
+	ctx.published = true
+	ctx.Hub.Broadcast <- msg
+}
+
+type commandRegistry struct {
+	mu        sync.RWMutex
+	commands  map[string]Command
+	reminders map[int]int // pending /remind timers per user
+}
+
+// RegisterCommand adds a slash command. Names are unique; registering one twice is an error.
+func (h *Hub) RegisterCommand(cmd Command) error {
+	if !commandName.MatchString(cmd.Name) {
+		return fmt.Errorf("invalid command name %q", cmd.Name)
+	}
+	if cmd.Run == nil {
+		return fmt.Errorf("command /%s has no Run function", cmd.Name)
+	}
+	h.commands.mu.Lock()
+	defer h.commands.mu.Unlock()
+	if _, exists := h.commands.commands[cmd.Name]; exists {
+		return fmt.Errorf("command /%s is already registered", cmd.Name)
+	}
+	h.commands.commands[cmd.Name] = cmd
+	return nil
+}
+
+// Commands lists the registered commands by name.
+func (h *Hub) Commands() []Command {
+	h.commands.mu.RLock()
+	defer h.commands.mu.RUnlock()
+	commands := make([]Command, 0, len(h.commands.commands))
+	for _, cmd := range h.commands.commands {
+		commands = append(commands, cmd)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// runCommand handles a chat line that starts with "/". It reports false when the line is
+// not command syntax at all (e.g. "/usr/bin"), in which case it is sent as a message.
+func (h *Hub) runCommand(c *Client, msg Frontend) bool {
+	name, args := msg.Content[1:], ""
+	if i := strings.IndexFunc(name, unicode.IsSpace); i >= 0 {
+		name, args = name[:i], name[i:]
+	}
+	name = strings.ToLower(name)
+	if !commandName.MatchString(name) {
+		return false
+	}
+
+	h.commands.mu.RLock()
+	cmd, ok := h.commands.commands[name]
+	h.commands.mu.RUnlock()
+
+	ctx := &CommandContext{Hub: h, UserID: c.UserID, Args: strings.TrimSpace(args), Message: msg}
+	var err error
+	if ok && cmd.Public && h.encryptedConversation(c.UserID, msg.To) {
+		err = fmt.Errorf("/%s is not available in end-to-end encrypted conversations.", name)
+	} else if ok {
+		err = cmd.Run(ctx)
+	} else {
+		err = fmt.Errorf("Unknown command /%s. Type /help for the list, or start with // to send a message beginning with /.", name)
+	}
+	if err != nil {
+		ctx.ReplyPrivate(err.Error())
+	}
+	// The browser waits for an ack before it stops resending the line
+	if !ctx.published {
+		c.ack(msg.ClientID, Frontend{From: c.UserID, To: msg.To, RoomID: msg.RoomID}, time.Now().UTC())
+	}
+	return true
+}
+
+// encryptedConversation reports whether both sides of a DM have an active key, i.e. their
+// browsers seal messages to each other. A public command there would post plaintext.
+func (h *Hub) encryptedConversation(userID, peerID int) bool {
+	if peerID == 0 {
+		return false
+	}
+	for _, id := range []int{userID, peerID} {
+		var count int
+		err := h.DB.QueryRow(`SELECT COUNT(*) FROM user_keys WHERE user_id = ? AND revoked_at IS NULL`, id).Scan(&count)
+		if err != nil {
+			fmt.Println("Error checking encryption keys:", err)
+			return true
+		}
+		if count == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Hub) registerBuiltinCommands() {
+	for _, cmd := range []Command{
+		{Name: "help", Usage: "/help", Description: "List the available commands", Run: helpCommand},
+		{Name: "me", Usage: "/me <action>", Description: "Describe what you are doing", Public: true, Run: meCommand},
+		{Name: "shrug", Usage: "/shrug [text]", Description: `Append ¯\_(ツ)_/¯ to your message`, Public: true, Run: shrugCommand},
+		{Name: "remind", Usage: "/remind <duration> <text>", Description: "Remind yourself later, e.g. /remind 10m stand up", Run: remindCommand},
+		{Name: "post", Usage: "/post <title> [| <body>]", Description: "Create a forum post", Public: true, Run: postCommand},
+	} {
+		if err := h.RegisterCommand(cmd); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func helpCommand(ctx *CommandContext) error {
+	var b strings.Builder
+	b.WriteString("Commands:")
+	for _, cmd := range ctx.Hub.Commands() {
+		fmt.Fprintf(&b, "\n%s — %s", cmd.Usage, cmd.Description)
+	}
+	ctx.ReplyPrivate(b.String())
+	return nil
+}
+
+func meCommand(ctx *CommandContext) error {
+	if ctx.Args == "" {
+		return errors.New("Usage: /me <action>")
+	}
+	names, err := usernames(ctx.Hub.DB, ctx.UserID)
+	if err != nil {
+		fmt.Println("Error loading username:", err)
+		return errors.New("Something went wrong; please try again.")
+	}
+	ctx.ReplyPublic(fmt.Sprintf("* %s %s", names[ctx.UserID], ctx.Args))
+	return nil
+}
+
+func shrugCommand(ctx *CommandContext) error {
+	ctx.ReplyPublic(strings.TrimSpace(ctx.Args + ` ¯\_(ツ)_/¯`))
+	return nil
+}
+
+// remindCommand sends the user a private reminder after a delay. Reminders are kept in
+// memory only, so a restart drops the pending ones.
+func remindCommand(ctx *CommandContext) error {
+	usage := errors.New("Usage: /remind <duration> <text>, e.g. /remind 10m stand up (up to 7d)")
+	delayText, text, _ := strings.Cut(ctx.Args, " ")
+	text = strings.TrimSpace(text)
+	delay, err := parseReminderDelay(delayText)
+	if err != nil || text == "" {
+		return usage
+	}
+	if delay < minReminder || delay > maxReminder {
+		return usage
+	}
+
+	registry := ctx.Hub.commands
+	registry.mu.Lock()
+	if registry.reminders[ctx.UserID] >= maxPendingReminders {
+		registry.mu.Unlock()
+		return fmt.Errorf("You already have %d reminders pending.", maxPendingReminders)
+	}
+	registry.reminders[ctx.UserID]++
+	registry.mu.Unlock()
+
+	time.AfterFunc(delay, func() {
+		registry.mu.Lock()
+		if registry.reminders[ctx.UserID]--; registry.reminders[ctx.UserID] <= 0 {
+			delete(registry.reminders, ctx.UserID)
+		}
+		registry.mu.Unlock()
+		ctx.ReplyPrivate("⏰ Reminder: " + text)
+	})
+	ctx.ReplyPrivate(fmt.Sprintf("OK, I'll remind you in %s.", delay))
+	return nil
+}
+
+// parseReminderDelay reads a Go duration ("90s", "1h30m") or a number of days ("2d").
+func parseReminderDelay(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// postCommand creates a forum post. Without a "| body" part the title is used as the body.
+func postCommand(ctx *CommandContext) error {
+	title, body, hasBody := strings.Cut(ctx.Args, "|")
+	title, body = strings.TrimSpace(title), strings.TrimSpace(body)
+	if !hasBody {
+		body = title
+	}
+	if title == "" || body == "" {
+		return errors.New("Usage: /post <title> [| <body>]")
+	}
+	if len([]rune(title)) > maxPostTitleLength {
+		return fmt.Errorf("Post titles are limited to %d characters.", maxPostTitleLength)
+	}
+
+	db := ctx.Hub.DB
+	postID, _, err := database.InsertPost(db, ctx.UserID, title, body)
+	if err == nil {
+		var categoryID int
+		if categoryID, err = database.GetCategoryID(db, "none"); err == nil {
+			err = database.InsertPostCategory(db, int(postID), categoryID)
+		}
+	}
+	if err != nil {
+		fmt.Println("Error creating post from chat:", err)
+		return errors.New("The post could not be created; please try again.")
+	}
+
+	ctx.Hub.PublishForumEvent(Frontend{Type: TypeNewPost, From: ctx.UserID, PostId: int(postID)})
+	ctx.ReplyPrivate(fmt.Sprintf("Posted %q to the forum.", title))
+	return nil
+}
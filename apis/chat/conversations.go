@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type Conversation struct {
+	UserID      int       `json:"user_id"`
+	Username    string    `json:"username"`
+	LastMessage string    `json:"last_message"` // empty when the last message is end-to-end encrypted
+	Encrypted   bool      `json:"encrypted,omitempty"`
+	LastFrom    int       `json:"last_from"`
+	LastAt      time.Time `json:"last_at"`
+	Unread      int       `json:"unread"`
+	Online      bool      `json:"online"`
+}
+
+// GetConversations summarises every direct conversation of the user, most recent first.
+func GetConversations(db *sql.DB, userID int) ([]Conversation, error) {
+	return loadConversations(db, userID, 0)
+}
+
+// loadConversations runs the summary query, optionally restricted to a single peer.
+// Conversations with users the user blocked or was blocked by are left out.
+func loadConversations(db *sql.DB, userID, peerID int) ([]Conversation, error) {
+	hidden, err := HiddenUserIDs(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT c.peer_id, u.username, m.sender_id, m.content, m.encrypted, m.created_at,
+	                 (SELECT COUNT(*) FROM messages x
+	                  WHERE x.receiver_id = ? AND x.sender_id = c.peer_id AND x.read_at IS NULL AND x.deleted_at IS NULL)
+	          FROM (
+	              SELECT CASE WHEN sender_id = ? THEN receiver_id ELSE sender_id END AS peer_id, MAX(id) AS last_id
+	              FROM messages
+	              WHERE sender_id = ? OR receiver_id = ?
+	              GROUP BY peer_id
+	          ) c
+	          JOIN messages m ON m.id = c.last_id
+	          JOIN users u ON u.id = c.peer_id
+	          WHERE ? = 0 OR c.peer_id = ?
+	          ORDER BY m.created_at DESC, m.id DESC`
+	rows, err := db.Query(query, userID, userID, userID, userID, peerID, peerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []Conversation{}
+	for rows.Next() {
+		var c Conversation
+		if err := rows.Scan(&c.UserID, &c.Username, &c.LastFrom, &c.LastMessage, &c.Encrypted, &c.LastAt, &c.Unread); err != nil {
+			return nil, err
+		}
+		if hidden[c.UserID] {
+			continue
+		}
+		if c.Encrypted {
+			c.LastMessage = "" // ciphertext means nothing to the list; clients show a lock instead
+		}
+		conversations = append(conversations, c)
+	}
+	return conversations, rows.Err()
+}
+
+// Conversations returns the user's conversation summaries with live online flags.
+func (h *Hub) Conversations(userID int) ([]Conversation, error) {
+	conversations, err := GetConversations(h.DB, userID)
+	if err != nil {
+		return nil, err
+	}
+	online := make(map[int]bool)
+	for _, id := range h.GetOnlineUserIDs() {
+		online[id] = true
+	}
+	for i := range conversations {
+		conversations[i].Online = online[conversations[i].UserID]
+	}
+	return conversations, nil
+}
+
+// pushConversationUpdate sends the user a fresh summary of their conversation with peerID,
+// so the client can move it to the top of the list, or a conversation_removed frame once
+// no message is left or either of them blocked the other. It goes through the broker even
+// when the user is not connected here; instances without a connection of theirs drop it.
+func (h *Hub) pushConversationUpdate(userID, peerID int) {
+	conversations, err := loadConversations(h.DB, userID, peerID)
+	if err != nil {
+		fmt.Println("Error loading conversation summary:", err)
+		return
+	}
+	if len(conversations) == 0 {
+		h.sendToUser(userID, Frontend{Type: "conversation_removed", From: peerID, To: userID, Timestamp: time.Now().UTC()})
+		return
+	}
+	summary := conversations[0]
+	summary.Online = h.isOnline(peerID)
+	h.sendToUser(userID, Frontend{Type: "conversation_update", From: peerID, To: userID, Timestamp: summary.LastAt, Conversation: &summary})
+}
@@ -0,0 +1,130 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrNotMessageOwner = errors.New("message not found or not yours")
+
+// GetMessage loads a single direct message by ID.
+func GetMessage(db *sql.DB, messageID int64) (Frontend, error) {
+	messages, err := queryMessages(db, `SELECT `+messageColumns+` FROM messages WHERE id = ?`, messageID)
+	if err != nil {
+		return Frontend{}, err
+	}
+	if len(messages) == 0 {
+		return Frontend{}, sql.ErrNoRows
+	}
+	return messages[0], nil
+}
+
+// EditMessage replaces the content of a message the sender owns and has not deleted.
+// For an encrypted edit, content is the new ciphertext sealed as described by enc.
+func EditMessage(db *sql.DB, messageID int64, senderID int, content string, enc Encryption, at time.Time) (Frontend, error) {
+	query := `UPDATE messages SET content = ?, encrypted = ?, sender_key_id = ?, recipient_key_id = ?, nonce = ?, edited_at = ?
+	          WHERE id = ? AND sender_id = ? AND deleted_at IS NULL`
+	result, err := db.Exec(query, content, enc.Encrypted, nullString(enc.SenderKeyID), nullString(enc.RecipientKeyID), nullString(enc.Nonce),
+		at, messageID, senderID)
+	if err != nil {
+		return Frontend{}, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return Frontend{}, ErrNotMessageOwner
+	}
+	return GetMessage(db, messageID)
+}
+
+// DeleteMessage turns a message the sender owns into a tombstone: the row stays so
+// history and receipts keep their place, but the content, attachment and reactions are wiped.
+func DeleteMessage(db *sql.DB, messageID int64, senderID int, at time.Time) (Frontend, error) {
+	query := `UPDATE messages SET content = '', deleted_at = ? WHERE id = ? AND sender_id = ? AND deleted_at IS NULL`
+	result, err := db.Exec(query, at, messageID, senderID)
+	if err != nil {
+		return Frontend{}, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return Frontend{}, ErrNotMessageOwner
+	}
+	if err := deleteAttachments(db, messageID); err != nil {
+		return Frontend{}, err
+	}
+	if err := deleteReactions(db, messageID); err != nil {
+		return Frontend{}, err
+	}
+	return GetMessage(db, messageID)
+}
+
+// handleEditOrDelete applies an edit or delete from the message's sender and tells both participants.
+func (h *Hub) handleEditOrDelete(c *Client, msg Frontend) {
+	now := time.Now().UTC()
+	var updated Frontend
+	var err error
+
+	if msg.Type == "edit" {
+		content := strings.TrimSpace(msg.Content)
+		if content == "" {
+			c.sendError(msg, ErrCodeInvalid, "Message content cannot be empty.")
+			return
+		}
+		original, lookupErr := GetMessage(h.DB, msg.ID)
+		if lookupErr != nil || original.From != c.UserID {
+			c.sendError(msg, ErrCodeForbidden, "You can only change your own messages.")
+			return
+		}
+		// An edit keeps the message's encryption: a plaintext edit would downgrade an
+		// end-to-end conversation and get the new text indexed for search
+		if msg.Encrypted != original.Encrypted ||
+			(msg.Encrypted && (msg.SenderKeyID != original.SenderKeyID || msg.RecipientKeyID != original.RecipientKeyID)) {
+			c.sendError(msg, ErrCodeInvalid, "An edit must be encrypted the same way as the message it changes.")
+			return
+		}
+		msg.To = original.To
+		if err := checkEncryption(h.DB, msg); err != nil {
+			c.sendError(msg, ErrCodeInvalid, encryptionErrorMessage(err))
+			return
+		}
+		updated, err = EditMessage(h.DB, msg.ID, c.UserID, content, msg.Encryption, now)
+		updated.Type = "message_edited"
+	} else {
+		updated, err = DeleteMessage(h.DB, msg.ID, c.UserID, now)
+		updated.Type = "message_deleted"
+	}
+	if errors.Is(err, ErrNotMessageOwner) {
+		c.sendError(msg, ErrCodeForbidden, "You can only change your own messages.")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error updating message:", err)
+		c.sendError(msg, ErrCodeInternal, "The message could not be updated.")
+		return
+	}
+	c.ack(msg.ClientID, updated, now)
+
+	h.replaceStored(chatKey(updated.From, updated.To), updated)
+	h.sendToUser(updated.To, updated)
+	if updated.From != updated.To {
+		h.sendToUser(updated.From, updated)
+	}
+	// Either side's preview may show this message
+	h.pushConversationUpdate(updated.To, updated.From)
+	if updated.From != updated.To {
+		h.pushConversationUpdate(updated.From, updated.To)
+	}
+}
+
+// replaceStored swaps the in-memory copy of a message for its updated version.
+func (h *Hub) replaceStored(key string, updated Frontend) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	for i, stored := range h.MessageStore[key] {
+		if stored.ID == updated.ID {
+			updated.Type = stored.Type
+			h.MessageStore[key][i] = updated
+			return
+		}
+	}
+}
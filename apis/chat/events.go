@@ -0,0 +1,21 @@
+package chat
+
+import "time"
+
+// Publisher lets the forum's HTTP handlers announce changes to every connected browser.
+// Events are only ever created on the server, after the change has been stored.
+type Publisher interface {
+	PublishForumEvent(event Frontend)
+}
+
+// InteractionCounts is the like/dislike tally carried by like events.
+type InteractionCounts struct {
+	Likes    int `json:"likes"`
+	Dislikes int `json:"dislikes"`
+}
+
+// PublishForumEvent sends a new_post, new_comment, new_postLike or new_commentLike event to everyone.
+func (h *Hub) PublishForumEvent(event Frontend) {
+	event.Timestamp = time.Now().UTC()
+	h.sendToAll(event)
+}
@@ -0,0 +1,264 @@
+package chat
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	u "forum/apis/user"
+
+	_ "time/tzdata" // so ?tz= works on hosts without a zoneinfo database
+)
+
+const exportBatchSize = 500
+
+type ExportedMessage struct {
+	ID         int64       `json:"id"`
+	FromID     int         `json:"from_id"`
+	From       string      `json:"from"`
+	ToID       int         `json:"to_id"`
+	To         string      `json:"to"`
+	Timestamp  string      `json:"timestamp"` // RFC 3339 in the requested time zone
+	Content    string      `json:"content"`   // base64 ciphertext when encrypted
+	EditedAt   string      `json:"edited_at,omitempty"`
+	Deleted    bool        `json:"deleted,omitempty"`
+	Encrypted  bool        `json:"encrypted,omitempty"`
+	ReplyTo    int64       `json:"reply_to,omitempty"`
+	Attachment *Attachment `json:"attachment,omitempty"`
+}
+
+type exportHeader struct {
+	UserID     int
+	Username   string
+	PeerID     int
+	PeerName   string
+	TimeZone   string
+	ExportedAt string
+}
+
+// exportWriter writes one format of conversation export: a header, each message, then a footer.
+type exportWriter interface {
+	begin(h exportHeader) error
+	message(m ExportedMessage) error
+	end() error
+}
+
+// ExportConversation serves /messages/export?with=ID&format=json|html&tz=Area/City. It streams
+// every message between the requester and the other user, oldest first, so only the two
+// participants can ever export a conversation.
+func ExportConversation(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	userID, loggedIn := u.ValidateSession(db, r)
+	if !loggedIn {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	peerID, err := strconv.Atoi(query.Get("with"))
+	if err != nil || peerID <= 0 {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	loc := time.UTC
+	if tz := query.Get("tz"); tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			http.Error(w, "Unknown time zone", http.StatusBadRequest)
+			return
+		}
+	}
+
+	names, err := usernames(db, userID, peerID)
+	if err != nil {
+		fmt.Println("Error loading usernames:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if names[peerID] == "" {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	format := query.Get("format")
+	out := bufio.NewWriter(w)
+	var writer exportWriter
+	switch format {
+	case "", "json":
+		format = "json"
+		writer = &jsonExport{w: out}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	case "html":
+		writer = &htmlExport{w: out}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	default:
+		http.Error(w, "format must be json or html", http.StatusBadRequest)
+		return
+	}
+	filename := fmt.Sprintf("chat-%s-%s.%s", names[userID], names[peerID], format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// Headers are sent by now, so a failure part-way can only be logged
+	err = writer.begin(exportHeader{
+		UserID: userID, Username: names[userID], PeerID: peerID, PeerName: names[peerID],
+		TimeZone: loc.String(), ExportedAt: time.Now().In(loc).Format(time.RFC3339),
+	})
+	if err == nil {
+		err = exportMessages(db, userID, peerID, loc, names, writer)
+	}
+	if err == nil {
+		err = writer.end()
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		fmt.Println("Error exporting conversation:", err)
+	}
+}
+
+func exportMessages(db *sql.DB, userID, peerID int, loc *time.Location, names map[int]string, writer exportWriter) error {
+	q := PageQuery{After: &Cursor{}, Limit: exportBatchSize}
+	for {
+		page, err := GetDirectHistory(db, userID, peerID, q)
+		if err != nil {
+			return err
+		}
+		for _, m := range page.Messages {
+			exported := ExportedMessage{
+				ID: m.ID, FromID: m.From, From: names[m.From], ToID: m.To, To: names[m.To],
+				Timestamp: m.Timestamp.In(loc).Format(time.RFC3339),
+				Content:   m.Content, Deleted: m.DeletedAt != nil, Encrypted: m.Encrypted, ReplyTo: m.ReplyTo, Attachment: m.Attachment,
+			}
+			if m.EditedAt != nil {
+				exported.EditedAt = m.EditedAt.In(loc).Format(time.RFC3339)
+			}
+			if err := writer.message(exported); err != nil {
+				return err
+			}
+		}
+		if page.NextCursor == nil {
+			return nil
+		}
+		last := page.Messages[len(page.Messages)-1]
+		q.After = &Cursor{CreatedAt: last.Timestamp, ID: last.ID}
+	}
+}
+
+func usernames(db *sql.DB, ids ...int) (map[int]string, error) {
+	names := make(map[int]string, len(ids))
+	for _, id := range ids {
+		var name string
+		err := db.QueryRow(`SELECT username FROM users WHERE id = ?`, id).Scan(&name)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		names[id] = name
+	}
+	return names, nil
+}
+
+type jsonExport struct {
+	w     io.Writer
+	count int
+}
+
+func (j *jsonExport) begin(h exportHeader) error {
+	head, err := json.Marshal(map[string]interface{}{
+		"participants": []map[string]interface{}{
+			{"id": h.UserID, "username": h.Username},
+			{"id": h.PeerID, "username": h.PeerName},
+		},
+		"time_zone":   h.TimeZone,
+		"exported_at": h.ExportedAt,
+	})
+	if err != nil {
+		return err
+	}
+	// Reopen the object to stream the messages array after the header fields
+	_, err = fmt.Fprintf(j.w, "%s,\"messages\":[", head[:len(head)-1])
+	return err
+}
+
+func (j *jsonExport) message(m ExportedMessage) error {
+	if j.count > 0 {
+		if _, err := io.WriteString(j.w, ","); err != nil {
+			return err
+		}
+	}
+	j.count++
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(data)
+	return err
+}
+
+func (j *jsonExport) end() error {
+	_, err := io.WriteString(j.w, "]}\n")
+	return err
+}
+
+var exportTemplates = template.Must(template.New("header").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Chat between {{.Username}} and {{.PeerName}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48rem; margin: 2rem auto; color: #222; }
+header { border-bottom: 1px solid #ccc; margin-bottom: 1rem; }
+.message { margin: 0.5rem 0; padding: 0.5rem 0.75rem; border-radius: 5px; background: #f8d7da; }
+.message.mine { background: #d1e7dd; }
+.meta { font-size: 0.8rem; color: #555; }
+.content { white-space: pre-wrap; margin-top: 0.25rem; }
+.note { font-style: italic; color: #777; }
+</style>
+</head>
+<body>
+<header>
+<h1>Chat between {{.Username}} and {{.PeerName}}</h1>
+<p class="meta">Exported {{.ExportedAt}} · Times shown in {{.TimeZone}}</p>
+</header>
+<main>
+`))
+
+func init() {
+	template.Must(exportTemplates.New("message").Parse(`<div class="message{{if .Mine}} mine{{end}}" id="m{{.ID}}">
+<div class="meta"><strong>{{.From}}</strong> · <time datetime="{{.Timestamp}}">{{.Timestamp}}</time>{{if .EditedAt}} · edited{{end}}{{if .ReplyTo}} · <a href="#m{{.ReplyTo}}">in reply</a>{{end}}</div>
+{{if .Deleted}}<div class="content note">Message deleted</div>
+{{else if .Encrypted}}<div class="content note">End-to-end encrypted message</div>
+{{else}}<div class="content">{{.Content}}</div>
+{{end}}{{with .Attachment}}<div class="meta">Attachment: {{.Filename}} ({{.Size}} bytes)</div>
+{{end}}</div>
+`))
+	template.Must(exportTemplates.New("footer").Parse(`</main>
+</body>
+</html>
+`))
+}
+
+type htmlExport struct {
+	w      io.Writer
+	userID int
+}
+
+func (x *htmlExport) begin(h exportHeader) error {
+	x.userID = h.UserID
+	return exportTemplates.ExecuteTemplate(x.w, "header", h)
+}
+
+func (x *htmlExport) message(m ExportedMessage) error {
+	return exportTemplates.ExecuteTemplate(x.w, "message", struct {
+		ExportedMessage
+		Mine bool
+	}{m, m.FromID == x.userID})
+}
+
+func (x *htmlExport) end() error {
+	return exportTemplates.ExecuteTemplate(x.w, "footer", nil)
+}
@@ -0,0 +1,47 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"forum/database"
+)
+
+// newTestDB creates a database with users 1 to 3, logged in with the session tokens
+// "tok1" to "tok3".
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "forum.db")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.CreateTables(db); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		_, err := db.Exec(`INSERT INTO users (username, firstname, lastname, age, gender, email, password)
+		                   VALUES (?, 'First', 'Last', '30', 'other', ?, 'x')`, fmt.Sprintf("user%d", i), fmt.Sprintf("user%d@example.com", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO sessions (user_id, token, expires_at) VALUES (?, ?, ?)`,
+			i, fmt.Sprintf("tok%d", i), time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// newTestHub starts a hub on db.
+func newTestHub(t *testing.T, db *sql.DB, broker Broker) *Hub {
+	t.Helper()
+	t.Cleanup(func() { broker.Close() })
+	hub := NewHub(db, broker)
+	go hub.Run()
+	return hub
+}
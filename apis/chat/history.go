@@ -0,0 +1,223 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageSize = 10
+	MaxPageSize     = 50
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks a position in a conversation by the (created_at, id) of a message.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        int64
+}
+
+// PageQuery describes one page of history: at most Limit messages strictly
+// before or strictly after a cursor, or the newest messages when neither is set.
+type PageQuery struct {
+	Before *Cursor
+	After  *Cursor
+	Limit  int
+}
+
+type Page struct {
+	Messages   []Frontend `json:"messages"`
+	NextCursor *string    `json:"next_cursor"`
+}
+
+func EncodeCursor(c Cursor) string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + strconv.FormatInt(c.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return Cursor{}, ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	messageID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || messageID <= 0 {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return Cursor{CreatedAt: time.Unix(0, n).UTC(), ID: messageID}, nil
+}
+
+// ParsePageQuery reads the before, after and limit query parameters.
+func ParsePageQuery(values url.Values) (PageQuery, error) {
+	q := PageQuery{Limit: DefaultPageSize}
+
+	if limitStr := values.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return q, errors.New("invalid limit")
+		}
+		q.Limit = min(limit, MaxPageSize)
+	}
+
+	if before := values.Get("before"); before != "" {
+		c, err := DecodeCursor(before)
+		if err != nil {
+			return q, err
+		}
+		q.Before = &c
+	}
+	if after := values.Get("after"); after != "" {
+		if q.Before != nil {
+			return q, errors.New("before and after are mutually exclusive")
+		}
+		c, err := DecodeCursor(after)
+		if err != nil {
+			return q, err
+		}
+		q.After = &c
+	}
+	return q, nil
+}
+
+// keysetClause returns the WHERE fragment, ORDER BY clause and arguments for the page.
+// Pages going backwards are returned newest first, pages going forwards oldest first.
+func (q PageQuery) keysetClause() (string, string, []interface{}) {
+	switch {
+	case q.After != nil:
+		return ` AND (created_at > ? OR (created_at = ? AND id > ?))`, ` ORDER BY created_at ASC, id ASC`,
+			[]interface{}{q.After.CreatedAt, q.After.CreatedAt, q.After.ID}
+	case q.Before != nil:
+		return ` AND (created_at < ? OR (created_at = ? AND id < ?))`, ` ORDER BY created_at DESC, id DESC`,
+			[]interface{}{q.Before.CreatedAt, q.Before.CreatedAt, q.Before.ID}
+	default:
+		return ``, ` ORDER BY created_at DESC, id DESC`, nil
+	}
+}
+
+// newPage trims the extra look-ahead row and derives the cursor for the following page.
+func newPage(messages []Frontend, limit int) Page {
+	page := Page{Messages: messages}
+	if len(messages) > limit {
+		page.Messages = messages[:limit]
+		last := page.Messages[limit-1]
+		next := EncodeCursor(Cursor{CreatedAt: last.Timestamp, ID: last.ID})
+		page.NextCursor = &next
+	}
+	return page
+}
+
+const messageColumns = `id, sender_id, receiver_id, content, created_at, delivered_at, read_at, edited_at, deleted_at,
+	encrypted, sender_key_id, recipient_key_id, nonce, expires_at, reply_to_id`
+
+// queryMessages runs a SELECT of messageColumns and returns the rows as frames,
+// with their attachments, reactions and the previews of the messages they reply to filled in.
+func queryMessages(db *sql.DB, query string, args ...interface{}) ([]Frontend, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanMessages(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadAttachments(db, messages); err != nil {
+		return nil, err
+	}
+	if err := loadReactions(db, messages); err != nil {
+		return nil, err
+	}
+	if err := loadReplyPreviews(db, messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func scanMessages(rows *sql.Rows) ([]Frontend, error) {
+	messages := []Frontend{}
+	for rows.Next() {
+		m := Frontend{Type: "message"}
+		var deliveredAt, readAt, editedAt, deletedAt, expiresAt sql.NullTime
+		var senderKeyID, recipientKeyID, nonce sql.NullString
+		var replyTo sql.NullInt64
+		if err := rows.Scan(&m.ID, &m.From, &m.To, &m.Content, &m.Timestamp, &deliveredAt, &readAt, &editedAt, &deletedAt,
+			&m.Encrypted, &senderKeyID, &recipientKeyID, &nonce, &expiresAt, &replyTo); err != nil {
+			return nil, err
+		}
+		m.ReplyTo = replyTo.Int64
+		m.ExpiresAt = nullTimePtr(expiresAt)
+		m.SenderKeyID, m.RecipientKeyID, m.Nonce = senderKeyID.String, recipientKeyID.String, nonce.String
+		m.DeliveredAt = nullTimePtr(deliveredAt)
+		m.ReadAt = nullTimePtr(readAt)
+		m.EditedAt = nullTimePtr(editedAt)
+		m.DeletedAt = nullTimePtr(deletedAt)
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// GetDirectHistory returns one page of the conversation between userID and withID.
+func GetDirectHistory(db *sql.DB, userID, withID int, q PageQuery) (Page, error) {
+	keyset, order, keysetArgs := q.keysetClause()
+	query := `SELECT ` + messageColumns + ` FROM messages
+	          WHERE ((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?))` +
+		keyset + order + ` LIMIT ?`
+
+	args := append([]interface{}{userID, withID, withID, userID}, keysetArgs...)
+	messages, err := queryMessages(db, query, append(args, q.Limit+1)...)
+	if err != nil {
+		return Page{}, err
+	}
+	return newPage(messages, q.Limit), nil
+}
+
+// GetRoomHistory returns one page of a room's messages as userID sees them: only those
+// sent after the user joined.
+func GetRoomHistory(db *sql.DB, roomID, userID int, q PageQuery) (Page, error) {
+	keyset, order, keysetArgs := q.keysetClause()
+	query := `SELECT id, sender_id, room_id, content, created_at FROM room_messages
+	          WHERE room_id = ? AND id > (SELECT visible_after_id FROM chat_room_members WHERE room_id = ? AND user_id = ?)` +
+		keyset + order + ` LIMIT ?`
+
+	args := append([]interface{}{roomID, roomID, userID}, keysetArgs...)
+	rows, err := db.Query(query, append(args, q.Limit+1)...)
+	if err != nil {
+		return Page{}, err
+	}
+	defer rows.Close()
+
+	messages := []Frontend{}
+	for rows.Next() {
+		m := Frontend{Type: "room_message"}
+		if err := rows.Scan(&m.ID, &m.From, &m.RoomID, &m.Content, &m.Timestamp); err != nil {
+			return Page{}, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return Page{}, err
+	}
+	return newPage(messages, q.Limit), nil
+}
@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"encoding/base64"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDecodeCursor(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 123, time.UTC)
+	valid := EncodeCursor(Cursor{CreatedAt: at, ID: 42})
+	encode := func(raw string) string { return base64.RawURLEncoding.EncodeToString([]byte(raw)) }
+
+	tests := []struct {
+		name    string
+		cursor  string
+		want    Cursor
+		wantErr bool
+	}{
+		{"round trip", valid, Cursor{CreatedAt: at, ID: 42}, false},
+		{"not base64", "!!!", Cursor{}, true},
+		{"no separator", encode("12345"), Cursor{}, true},
+		{"bad time", encode("noon:42"), Cursor{}, true},
+		{"bad id", encode("12345:x"), Cursor{}, true},
+		{"zero id", encode("12345:0"), Cursor{}, true},
+		{"negative id", encode("12345:-3"), Cursor{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeCursor(tt.cursor)
+			if tt.wantErr {
+				if err != ErrInvalidCursor {
+					t.Fatalf("err = %v, want ErrInvalidCursor", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.CreatedAt.Equal(tt.want.CreatedAt) || got.ID != tt.want.ID {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePageQuery(t *testing.T) {
+	cursor := EncodeCursor(Cursor{CreatedAt: time.Unix(1700000000, 0).UTC(), ID: 7})
+
+	tests := []struct {
+		name       string
+		query      string
+		wantLimit  int
+		wantBefore bool
+		wantAfter  bool
+		wantErr    bool
+	}{
+		{"defaults", "", DefaultPageSize, false, false, false},
+		{"limit", "limit=5", 5, false, false, false},
+		{"limit capped", "limit=1000", MaxPageSize, false, false, false},
+		{"zero limit", "limit=0", 0, false, false, true},
+		{"negative limit", "limit=-1", 0, false, false, true},
+		{"text limit", "limit=ten", 0, false, false, true},
+		{"before", "before=" + cursor, DefaultPageSize, true, false, false},
+		{"after", "after=" + cursor, DefaultPageSize, false, true, false},
+		{"before and after", "before=" + cursor + "&after=" + cursor, 0, false, false, true},
+		{"bad cursor", "before=nope", 0, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q, err := ParsePageQuery(values)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", q)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q.Limit != tt.wantLimit || (q.Before != nil) != tt.wantBefore || (q.After != nil) != tt.wantAfter {
+				t.Errorf("got limit %d, before %v, after %v", q.Limit, q.Before, q.After)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	e "forum/apis/error"
+	u "forum/apis/user"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxPublicKeyLength  = 1024     // base64 characters
+	maxCiphertextLength = 64 << 10 // base64 characters, well within maxMessageSize
+	maxNonceLength      = 64
+)
+
+// allowedKeyAlgorithms lists the key agreement schemes browsers may register keys for.
+// The server never uses the keys; it only hands them to the other participant.
+var allowedKeyAlgorithms = map[string]bool{
+	"ECDH-P256": true,
+	"X25519":    true,
+}
+
+var (
+	ErrInvalidPublicKey    = errors.New("public key must be base64 and use a supported algorithm")
+	ErrKeyNotFound         = errors.New("key not found")
+	ErrInvalidEnvelope     = errors.New("encrypted message is missing or has an invalid key ID, nonce or ciphertext")
+	ErrEncryptedAttachment = errors.New("attachments are stored in plaintext and cannot be sent in an encrypted message")
+)
+
+// Encryption describes how an end-to-end encrypted message was sealed. The content of such a
+// message is base64 ciphertext that only the two participants can open; the server stores
+// and relays it as-is.
+type Encryption struct {
+	Encrypted      bool   `json:"encrypted,omitempty"`
+	SenderKeyID    string `json:"sender_key_id,omitempty"`
+	RecipientKeyID string `json:"recipient_key_id,omitempty"`
+	Nonce          string `json:"nonce,omitempty"`
+}
+
+type PublicKey struct {
+	KeyID     string     `json:"key_id"`
+	UserID    int        `json:"user_id"`
+	Algorithm string     `json:"algorithm"`
+	PublicKey string     `json:"public_key"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"` // revoked keys stay listed so old messages can still be opened
+}
+
+func validPublicKey(algorithm, publicKey string) bool {
+	if !allowedKeyAlgorithms[algorithm] || publicKey == "" || len(publicKey) > maxPublicKeyLength {
+		return false
+	}
+	_, err := base64.StdEncoding.DecodeString(publicKey)
+	return err == nil
+}
+
+// RegisterKey stores a new public key for the user. With rotate set, the user's other active
+// keys are revoked in the same transaction, so peers switch to the new key at once.
+func RegisterKey(db *sql.DB, userID int, algorithm, publicKey string, rotate bool) (PublicKey, error) {
+	if !validPublicKey(algorithm, publicKey) {
+		return PublicKey{}, ErrInvalidPublicKey
+	}
+	key := PublicKey{KeyID: uuid.New().String(), UserID: userID, Algorithm: algorithm, PublicKey: publicKey, CreatedAt: time.Now().UTC()}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return PublicKey{}, err
+	}
+	defer tx.Rollback()
+
+	if rotate {
+		query := `UPDATE user_keys SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`
+		if _, err := tx.Exec(query, key.CreatedAt, userID); err != nil {
+			return PublicKey{}, err
+		}
+	}
+	query := `INSERT INTO user_keys (key_id, user_id, algorithm, public_key, created_at) VALUES (?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, key.KeyID, userID, algorithm, publicKey, key.CreatedAt); err != nil {
+		return PublicKey{}, err
+	}
+	return key, tx.Commit()
+}
+
+// RevokeKey stops a key from being used for new messages.
+func RevokeKey(db *sql.DB, userID int, keyID string) error {
+	query := `UPDATE user_keys SET revoked_at = ? WHERE key_id = ? AND user_id = ? AND revoked_at IS NULL`
+	result, err := db.Exec(query, time.Now().UTC(), keyID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// GetKeys lists a user's public keys, active ones first and newest first within each group.
+func GetKeys(db *sql.DB, userID int) ([]PublicKey, error) {
+	query := `SELECT key_id, user_id, algorithm, public_key, created_at, revoked_at FROM user_keys
+	          WHERE user_id = ?
+	          ORDER BY revoked_at IS NOT NULL, created_at DESC`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []PublicKey{}
+	for rows.Next() {
+		var k PublicKey
+		var revokedAt sql.NullTime
+		if err := rows.Scan(&k.KeyID, &k.UserID, &k.Algorithm, &k.PublicKey, &k.CreatedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		k.RevokedAt = nullTimePtr(revokedAt)
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func isActiveKey(db *sql.DB, userID int, keyID string) (bool, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM user_keys WHERE key_id = ? AND user_id = ? AND revoked_at IS NULL`
+	err := db.QueryRow(query, keyID, userID).Scan(&count)
+	return count > 0, err
+}
+
+// checkEncryption makes sure an encrypted message names active keys of both participants and
+// carries well-formed base64. It looks at the envelope only, never at the plaintext.
+// Attachments are refused: the server would have to store and serve the file in the clear.
+func checkEncryption(db *sql.DB, msg Frontend) error {
+	if !msg.Encrypted {
+		return nil
+	}
+	if msg.AttachmentID != 0 {
+		return ErrEncryptedAttachment
+	}
+	if msg.Nonce == "" || len(msg.Nonce) > maxNonceLength || len(msg.Content) > maxCiphertextLength {
+		return ErrInvalidEnvelope
+	}
+	if _, err := base64.StdEncoding.DecodeString(msg.Nonce); err != nil {
+		return ErrInvalidEnvelope
+	}
+	if _, err := base64.StdEncoding.DecodeString(msg.Content); err != nil {
+		return ErrInvalidEnvelope
+	}
+	for _, key := range []struct {
+		userID int
+		keyID  string
+	}{{msg.From, msg.SenderKeyID}, {msg.To, msg.RecipientKeyID}} {
+		active, err := isActiveKey(db, key.userID, key.keyID)
+		if err != nil {
+			return err
+		}
+		if !active {
+			return ErrInvalidEnvelope
+		}
+	}
+	return nil
+}
+
+// encryptionErrorMessage explains to the sender why checkEncryption refused a message.
+func encryptionErrorMessage(err error) string {
+	if errors.Is(err, ErrEncryptedAttachment) {
+		return "Attachments cannot be sent in end-to-end encrypted messages."
+	}
+	return "Encrypted messages need valid ciphertext, a nonce and active keys of both users."
+}
+
+// KeysHandler serves /keys: GET ?user_id= lists a user's keys (default: your own),
+// POST {"algorithm", "public_key"} registers one, DELETE ?key_id= revokes one of yours.
+func KeysHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	userID, loggedIn := u.ValidateSession(db, r)
+	if !loggedIn {
+		http.Error(w, "Unauthorized. Please log in.", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ownerID := userID
+		if value := r.URL.Query().Get("user_id"); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil || id <= 0 {
+				http.Error(w, "Invalid user ID", http.StatusBadRequest)
+				return
+			}
+			ownerID = id
+		}
+		keys, err := GetKeys(db, ownerID)
+		if err != nil {
+			fmt.Println(" Error loading keys:", err)
+			e.ErrorHandler(w, r, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	case http.MethodPost:
+		registerKey(db, w, r, userID, false)
+	case http.MethodDelete:
+		err := RevokeKey(db, userID, r.URL.Query().Get("key_id"))
+		if errors.Is(err, ErrKeyNotFound) {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Println(" Error revoking key:", err)
+			e.ErrorHandler(w, r, 500)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// RotateKeyHandler serves POST /keys/rotate: it registers a new key and revokes the old ones.
+func RotateKeyHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, loggedIn := u.ValidateSession(db, r)
+	if !loggedIn {
+		http.Error(w, "Unauthorized. Please log in.", http.StatusUnauthorized)
+		return
+	}
+	registerKey(db, w, r, userID, true)
+}
+
+func registerKey(db *sql.DB, w http.ResponseWriter, r *http.Request, userID int, rotate bool) {
+	var req struct {
+		Algorithm string `json:"algorithm"`
+		PublicKey string `json:"public_key"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	key, err := RegisterKey(db, userID, req.Algorithm, req.PublicKey, rotate)
+	if errors.Is(err, ErrInvalidPublicKey) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Println(" Error registering key:", err)
+		e.ErrorHandler(w, r, 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
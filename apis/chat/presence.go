@@ -0,0 +1,230 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	presenceHeartbeat = 15 * time.Second
+	presenceTimeout   = 3 * presenceHeartbeat // an instance silent this long is presumed dead
+)
+
+// SetLastSeen records when the user's last connection closed.
+func SetLastSeen(db *sql.DB, userID int, at time.Time) error {
+	_, err := db.Exec(`UPDATE users SET last_seen_at = ? WHERE id = ?`, at, userID)
+	return err
+}
+
+// announcePresence tells everyone online that a user came online or went offline.
+// Offline events carry the persisted last-seen time in Timestamp.
+func (h *Hub) announcePresence(userID int, online bool) {
+	event := Frontend{Type: "user_online", From: userID, Timestamp: time.Now().UTC()}
+	if !online {
+		event.Type = "user_offline"
+		if err := SetLastSeen(h.DB, userID, event.Timestamp); err != nil {
+			fmt.Println("Error saving last seen:", err)
+		}
+	}
+	h.sendToAll(event)
+}
+
+// Presence is shared between hub instances through chat_presence, which holds each
+// instance's connection count per user. Only instances that heartbeat within
+// presenceTimeout are counted, so a crashed instance does not keep its users online.
+
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func liveCutoff() time.Time {
+	return time.Now().UTC().Add(-presenceTimeout)
+}
+
+// connectionCount returns how many connections the user has open on all live instances.
+func connectionCount(q querier, userID int) (int, error) {
+	var count int
+	query := `SELECT COALESCE(SUM(p.connections), 0) FROM chat_presence p
+	          JOIN chat_instances i ON i.instance_id = p.instance_id
+	          WHERE p.user_id = ? AND i.heartbeat_at > ?`
+	err := q.QueryRow(query, userID, liveCutoff()).Scan(&count)
+	return count, err
+}
+
+// onOtherInstance reports whether the user has a connection on a live instance other than this one.
+func (h *Hub) onOtherInstance(userID int) (bool, error) {
+	var count int
+	query := `SELECT COALESCE(SUM(p.connections), 0) FROM chat_presence p
+	          JOIN chat_instances i ON i.instance_id = p.instance_id
+	          WHERE p.user_id = ? AND p.instance_id != ? AND i.heartbeat_at > ?`
+	err := h.DB.QueryRow(query, userID, h.instanceID, liveCutoff()).Scan(&count)
+	return count > 0, err
+}
+
+// presenceConnect counts a new connection of the user on this instance and reports whether
+// it is their first on any instance.
+func (h *Hub) presenceConnect(userID int) (first bool, err error) {
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	before, err := connectionCount(tx, userID)
+	if err != nil {
+		return false, err
+	}
+	query := `INSERT INTO chat_presence (instance_id, user_id, connections) VALUES (?, ?, 1)
+	          ON CONFLICT (instance_id, user_id) DO UPDATE SET connections = connections + 1`
+	if _, err := tx.Exec(query, h.instanceID, userID); err != nil {
+		return false, err
+	}
+	return before == 0, tx.Commit()
+}
+
+// presenceDisconnect counts a closed connection of the user on this instance and reports
+// whether it was their last on any instance.
+func (h *Hub) presenceDisconnect(userID int) (last bool, err error) {
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE chat_presence SET connections = connections - 1 WHERE instance_id = ? AND user_id = ?`,
+		h.instanceID, userID); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM chat_presence WHERE instance_id = ? AND user_id = ? AND connections <= 0`,
+		h.instanceID, userID); err != nil {
+		return false, err
+	}
+	after, err := connectionCount(tx, userID)
+	if err != nil {
+		return false, err
+	}
+	return after == 0, tx.Commit()
+}
+
+// isOnline reports whether the user has a connection on any instance.
+func (h *Hub) isOnline(userID int) bool {
+	h.Mutex.RLock()
+	local := len(h.Clients[userID]) > 0
+	h.Mutex.RUnlock()
+	if local {
+		return true
+	}
+	count, err := connectionCount(h.DB, userID)
+	if err != nil {
+		fmt.Println("Error checking presence:", err)
+		return false
+	}
+	return count > 0
+}
+
+// GetOnlineUserIDs lists the users connected to any instance.
+func (h *Hub) GetOnlineUserIDs() []int {
+	query := `SELECT DISTINCT p.user_id FROM chat_presence p
+	          JOIN chat_instances i ON i.instance_id = p.instance_id
+	          WHERE p.connections > 0 AND i.heartbeat_at > ?`
+	rows, err := h.DB.Query(query, liveCutoff())
+	if err != nil {
+		fmt.Println("Error listing online users:", err)
+		return h.localUserIDs()
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			fmt.Println("Error listing online users:", err)
+			return h.localUserIDs()
+		}
+		userIDs = append(userIDs, id)
+	}
+	return userIDs
+}
+
+func (h *Hub) localUserIDs() []int {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+
+	var userIDs []int
+	for id := range h.Clients {
+		userIDs = append(userIDs, id)
+	}
+	return userIDs
+}
+
+func (h *Hub) heartbeat() error {
+	query := `INSERT INTO chat_instances (instance_id, heartbeat_at) VALUES (?, ?)
+	          ON CONFLICT (instance_id) DO UPDATE SET heartbeat_at = excluded.heartbeat_at`
+	_, err := h.DB.Exec(query, h.instanceID, time.Now().UTC())
+	return err
+}
+
+// watchPresence runs for the life of the hub: it keeps this instance's heartbeat fresh and
+// removes instances that stopped, announcing their users offline unless they are still
+// connected elsewhere.
+func (h *Hub) watchPresence() {
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := h.heartbeat(); err != nil {
+			fmt.Println("Error updating chat heartbeat:", err)
+		}
+		orphaned, err := reapDeadInstances(h.DB)
+		if err != nil {
+			fmt.Println("Error removing stopped chat instances:", err)
+			continue
+		}
+		for _, userID := range orphaned {
+			if !h.isOnline(userID) {
+				h.announcePresence(userID, false)
+			}
+		}
+	}
+}
+
+// reapDeadInstances deletes the presence of instances that stopped heartbeating and returns
+// the users they had connected.
+func reapDeadInstances(db *sql.DB) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	cutoff := liveCutoff()
+	rows, err := tx.Query(`SELECT DISTINCT p.user_id FROM chat_presence p
+	                       JOIN chat_instances i ON i.instance_id = p.instance_id
+	                       WHERE i.heartbeat_at <= ?`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query := `DELETE FROM chat_presence WHERE instance_id IN (SELECT instance_id FROM chat_instances WHERE heartbeat_at <= ?)`
+	if _, err := tx.Exec(query, cutoff); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM chat_instances WHERE heartbeat_at <= ?`, cutoff); err != nil {
+		return nil, err
+	}
+	return userIDs, tx.Commit()
+}
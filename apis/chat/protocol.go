@@ -0,0 +1,213 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ProtocolVersion is the websocket envelope version this server speaks. Every frame it
+// sends carries it in "v"; frames from browsers that leave "v" out are read as this version.
+const ProtocolVersion = 1
+
+// maxClientIDLength bounds the client-generated ID a browser may attach to a frame.
+const maxClientIDLength = 64
+
+// Frame types sent by browsers.
+const (
+	TypeMessage     = "message"
+	TypeRoomMessage = "room_message"
+	TypeTyping      = "typing"
+	TypeRead        = "read"
+	TypeEdit        = "edit"
+	TypeDelete      = "delete"
+	TypeCreateRoom  = "create_room"
+	TypeInviteRoom  = "invite_room" // a member invites the users in Members
+	TypeJoinRoom    = "join_room"   // accepts an invitation
+	TypeLeaveRoom   = "leave_room"
+	TypeReact       = "react"
+	TypeUnreact     = "unreact"
+)
+
+// Frame types only the server sends.
+const (
+	TypeAck   = "ack"   // a frame was persisted; carries its client_id, ID and timestamp
+	TypeError = "error" // a frame was rejected; carries its client_id and an error object
+
+	TypeAnnouncement = "announcement" // server-wide notice from an administrator
+	TypeHello        = "hello"        // first frame of an SSE stream; carries its conn_id
+	TypeReaction     = "reaction"     // a message's reactions changed; carries the new totals
+	TypeSystem       = "system"       // private notice to one user, e.g. a slash command's reply
+
+	// Forum events, published by the HTTP handlers that made the change
+	TypeNewPost        = "new_post"
+	TypeNewComment     = "new_comment"
+	TypeNewPostLike    = "new_postLike"
+	TypeNewCommentLike = "new_commentLike"
+)
+
+// Error codes carried in error frames.
+const (
+	ErrCodeMalformed          = "malformed_frame"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalid            = "invalid_request"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeInternal           = "internal_error"
+	ErrCodeRateLimited        = "rate_limited"
+)
+
+type FrameError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type frameHandler func(h *Hub, c *Client, msg Frontend)
+
+// frameHandlers dispatches browser frames by type; anything else is answered with an error frame.
+var frameHandlers = map[string]frameHandler{
+	TypeMessage:     (*Hub).handleChatMessage,
+	TypeRoomMessage: (*Hub).handleChatMessage,
+	TypeTyping:      (*Hub).handleTyping,
+	TypeRead:        (*Hub).handleRead,
+	TypeEdit:        (*Hub).handleEditOrDelete,
+	TypeDelete:      (*Hub).handleEditOrDelete,
+	TypeCreateRoom:  (*Hub).handleRoomControl,
+	TypeInviteRoom:  (*Hub).handleRoomControl,
+	TypeJoinRoom:    (*Hub).handleRoomControl,
+	TypeLeaveRoom:   (*Hub).handleRoomControl,
+	TypeReact:       (*Hub).handleReaction,
+	TypeUnreact:     (*Hub).handleReaction,
+}
+
+// serverOnlyTypes are frame types browsers used to relay themselves; they are now refused
+// so nobody can spoof forum activity.
+var serverOnlyTypes = map[string]bool{
+	TypeAck:            true,
+	TypeError:          true,
+	TypeNewPost:        true,
+	TypeNewComment:     true,
+	TypeNewPostLike:    true,
+	TypeNewCommentLike: true,
+	TypeAnnouncement:   true,
+	TypeHello:          true,
+	TypeReaction:       true,
+	TypeSystem:         true,
+}
+
+// dispatch validates the envelope of a decoded frame and hands it to its handler.
+func (h *Hub) dispatch(c *Client, msg Frontend) {
+	if msg.V != 0 && msg.V != ProtocolVersion {
+		c.sendError(msg, ErrCodeUnsupportedVersion, fmt.Sprintf("Protocol version %d is not supported; use %d.", msg.V, ProtocolVersion))
+		return
+	}
+	if len(msg.ClientID) > maxClientIDLength {
+		c.sendError(Frontend{}, ErrCodeInvalid, "client_id is too long.")
+		return
+	}
+	if serverOnlyTypes[msg.Type] {
+		c.sendError(msg, ErrCodeForbidden, fmt.Sprintf("%q frames can only be sent by the server.", msg.Type))
+		return
+	}
+	handler, ok := frameHandlers[msg.Type]
+	if !ok {
+		c.sendError(msg, ErrCodeUnknownType, fmt.Sprintf("Unknown frame type %q.", msg.Type))
+		return
+	}
+
+	msg.From = c.UserID
+	msg.origin = c
+	msg.Error = nil
+	handler(h, c, msg)
+}
+
+func (h *Hub) handleChatMessage(c *Client, msg Frontend) {
+	if msg.Type == TypeRoomMessage && msg.RoomID <= 0 {
+		c.sendError(msg, ErrCodeInvalid, "room_id is required.")
+		return
+	}
+	if msg.Type == TypeMessage && msg.To <= 0 {
+		c.sendError(msg, ErrCodeInvalid, "to is required.")
+		return
+	}
+	if msg.Type == TypeRoomMessage && msg.Encrypted {
+		c.sendError(msg, ErrCodeInvalid, "Room messages cannot be end-to-end encrypted.")
+		return
+	}
+	if msg.Type == TypeRoomMessage && msg.ReplyTo != 0 {
+		c.sendError(msg, ErrCodeInvalid, "Replies are only supported in direct messages.")
+		return
+	}
+	if msg.Type == TypeRoomMessage && msg.AttachmentID != 0 {
+		c.sendError(msg, ErrCodeInvalid, "Attachments are only supported in direct messages.")
+		return
+	}
+	if strings.TrimSpace(msg.Content) == "" && msg.AttachmentID == 0 {
+		c.sendError(msg, ErrCodeInvalid, "Message content cannot be empty.")
+		return
+	}
+	// Slash commands run instead of being stored; "//" sends a literal leading slash
+	if !msg.Encrypted && strings.HasPrefix(msg.Content, "/") {
+		if strings.HasPrefix(msg.Content, "//") {
+			msg.Content = msg.Content[1:]
+		} else if h.runCommand(c, msg) {
+			return
+		}
+	}
+	msg.Timestamp = time.Now().UTC()
+	h.Broadcast <- msg
+}
+
+func (h *Hub) handleTyping(c *Client, msg Frontend) {
+	if blocked, err := IsBlocked(h.DB, msg.From, msg.To); err == nil && !blocked {
+		h.sendToUser(msg.To, msg)
+	}
+}
+
+// sendError tells the client that the frame ref was rejected.
+func (c *Client) sendError(ref Frontend, code, message string) {
+	c.hub.sendToClient(c, Frontend{
+		Type:      TypeError,
+		To:        c.UserID,
+		ClientID:  ref.ClientID,
+		Error:     &FrameError{Code: code, Message: message},
+		Timestamp: time.Now().UTC(),
+	})
+}
+
+// ack tells the client that its frame was persisted as saved, so it can stop retrying.
+func (c *Client) ack(clientID string, saved Frontend, at time.Time) {
+	c.hub.sendToClient(c, Frontend{
+		Type:      TypeAck,
+		ID:        saved.ID,
+		From:      saved.From,
+		To:        saved.To,
+		RoomID:    saved.RoomID,
+		ClientID:  clientID,
+		Timestamp: at,
+	})
+}
+
+// findByClientID looks up a message the sender already stored under clientID, so a retried
+// frame is acknowledged again instead of being saved twice.
+func findByClientID(db *sql.DB, table string, senderID int, clientID string) (id int64, createdAt time.Time, found bool, err error) {
+	if clientID == "" {
+		return 0, time.Time{}, false, nil
+	}
+	query := `SELECT id, created_at FROM ` + table + ` WHERE sender_id = ? AND client_id = ?`
+	err = db.QueryRow(query, senderID, clientID).Scan(&id, &createdAt)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, false, nil
+	}
+	return id, createdAt, err == nil, err
+}
+
+// nullableClientID stores an absent client ID as NULL, which the unique index ignores.
+func nullableClientID(clientID string) sql.NullString {
+	return nullString(clientID)
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
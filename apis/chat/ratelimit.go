@@ -0,0 +1,228 @@
+package chat
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	maxStrikes   = 10              // rate-limit violations tolerated within strikeWindow
+	strikeWindow = time.Minute     // violations older than this are forgotten
+	banDuration  = 2 * time.Minute // how long a repeat offender stays disconnected
+)
+
+// frameClass groups frame types that share a rate budget.
+type frameClass int
+
+const (
+	classChat      frameClass = iota // messages, edits, receipts and room changes
+	classTyping                      // typing signals
+	classBroadcast                   // forum event frames, refused but still counted so floods are cut off
+	numFrameClasses
+)
+
+var frameClassNames = [numFrameClasses]string{"CHAT", "TYPING", "BROADCAST"}
+
+func classOf(frameType string) frameClass {
+	switch frameType {
+	case TypeTyping:
+		return classTyping
+	case TypeNewPost, TypeNewComment, TypeNewPostLike, TypeNewCommentLike:
+		return classBroadcast
+	}
+	return classChat
+}
+
+// RateLimit is a token bucket: Rate frames per second on average, bursts of up to Burst.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// Default budgets, overridable with FORUM_CHAT_RATE_<CLASS> (per connection) and
+// FORUM_CHAT_USER_RATE_<CLASS> (per user, across devices), written as "rate/burst", e.g. "2/10".
+var (
+	defaultConnLimits = [numFrameClasses]RateLimit{{Rate: 2, Burst: 10}, {Rate: 4, Burst: 8}, {Rate: 0.5, Burst: 5}}
+	defaultUserLimits = [numFrameClasses]RateLimit{{Rate: 4, Burst: 20}, {Rate: 8, Burst: 16}, {Rate: 1, Burst: 10}}
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time since it was last used and spends one token if it can.
+func (b *bucket) take(limit RateLimit, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = limit.Burst
+	} else {
+		b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type userRate struct {
+	buckets     [numFrameClasses]bucket
+	strikes     int
+	firstStrike time.Time
+	bannedUntil time.Time
+}
+
+type rateLimiter struct {
+	conn  [numFrameClasses]RateLimit
+	user  [numFrameClasses]RateLimit
+	mu    sync.Mutex
+	users map[int]*userRate
+}
+
+func newRateLimiterFromEnv() *rateLimiter {
+	l := &rateLimiter{conn: defaultConnLimits, user: defaultUserLimits, users: make(map[int]*userRate)}
+	for class, name := range frameClassNames {
+		l.conn[class] = rateLimitFromEnv("FORUM_CHAT_RATE_"+name, l.conn[class])
+		l.user[class] = rateLimitFromEnv("FORUM_CHAT_USER_RATE_"+name, l.user[class])
+	}
+	return l
+}
+
+func rateLimitFromEnv(key string, fallback RateLimit) RateLimit {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	rate, burst, _ := strings.Cut(value, "/")
+	r, err1 := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+	b, err2 := strconv.ParseFloat(strings.TrimSpace(burst), 64)
+	if err1 != nil || err2 != nil || r <= 0 || b < 1 {
+		fmt.Printf("Ignoring %s=%q; expected \"rate/burst\"\n", key, value)
+		return fallback
+	}
+	return RateLimit{Rate: r, Burst: b}
+}
+
+// allow spends a token from both the connection's and the user's bucket for the class.
+// A refusal counts as a strike; banned reports that the user has run out of strikes.
+func (l *rateLimiter) allow(c *Client, class frameClass, now time.Time) (ok, banned bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	u := l.users[c.UserID]
+	if u == nil {
+		u = &userRate{}
+		l.users[c.UserID] = u
+	}
+	if now.Before(u.bannedUntil) {
+		return false, true
+	}
+	// Both buckets are charged so a flood across many tabs still hits the user budget
+	connOK := c.buckets[class].take(l.conn[class], now)
+	userOK := u.buckets[class].take(l.user[class], now)
+	if connOK && userOK {
+		return true, false
+	}
+
+	if now.Sub(u.firstStrike) > strikeWindow {
+		u.strikes, u.firstStrike = 0, now
+	}
+	u.strikes++
+	if u.strikes >= maxStrikes {
+		u.bannedUntil = now.Add(banDuration)
+		u.strikes = 0
+		return false, true
+	}
+	return false, false
+}
+
+// bannedFor returns how long the user remains banned, or zero.
+func (l *rateLimiter) bannedFor(userID int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if u := l.users[userID]; u != nil && now.Before(u.bannedUntil) {
+		return u.bannedUntil.Sub(now)
+	}
+	return 0
+}
+
+func (l *rateLimiter) bannedCount(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := 0
+	for _, u := range l.users {
+		if now.Before(u.bannedUntil) {
+			count++
+		}
+	}
+	return count
+}
+
+// prune forgets users who are not banned and whose buckets have refilled.
+func (l *rateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for userID, u := range l.users {
+		idle := true
+		for _, b := range u.buckets {
+			if now.Sub(b.last) < strikeWindow {
+				idle = false
+			}
+		}
+		if idle && now.After(u.bannedUntil) {
+			delete(l.users, userID)
+		}
+	}
+}
+
+// checkRate applies the flood limits to a frame from c. Refused frames get an error frame;
+// once the user is banned every one of their connections is closed, after the frames already
+// queued for it and a last error frame saying why.
+func (h *Hub) checkRate(c *Client, msg Frontend) bool {
+	now := time.Now()
+	ok, banned := h.limits.allow(c, classOf(msg.Type), now)
+	if ok {
+		return true
+	}
+	if !banned {
+		c.sendError(msg, ErrCodeRateLimited, "Too many messages; slow down.")
+		return false
+	}
+
+	wait := int(math.Ceil(h.limits.bannedFor(c.UserID, now).Seconds()))
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	for client := range h.Clients[c.UserID] {
+		client.banOnce.Do(func() {
+			client.enqueue(Frontend{
+				Type:        TypeError,
+				To:          client.UserID,
+				Error:       &FrameError{Code: ErrCodeRateLimited, Message: fmt.Sprintf("Too many messages; you are disconnected for %d seconds.", wait)},
+				Timestamp:   now.UTC(),
+				closeCode:   websocket.CloseTryAgainLater,
+				closeReason: "rate limit exceeded",
+			})
+		})
+	}
+	return false
+}
+
+// rejectIfBanned answers 429 to a banned user trying to reconnect.
+func (h *Hub) rejectIfBanned(w http.ResponseWriter, userID int) bool {
+	wait := h.limits.bannedFor(userID, time.Now())
+	if wait == 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many messages; try again later", http.StatusTooManyRequests)
+	return true
+}
@@ -0,0 +1,35 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketTake(t *testing.T) {
+	limit := RateLimit{Rate: 2, Burst: 3}
+	start := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name  string
+		after time.Duration // since start
+		want  bool
+	}{
+		{"first token of the burst", 0, true},
+		{"second token", 0, true},
+		{"third token", 0, true},
+		{"burst spent", 0, false},
+		{"still empty", 100 * time.Millisecond, false},
+		{"refilled one token", 500 * time.Millisecond, true},
+		{"spent again", 500 * time.Millisecond, false},
+		{"refills no more than the burst", time.Hour, true},
+		{"second after long idle", time.Hour, true},
+		{"third after long idle", time.Hour, true},
+		{"burst spent after long idle", time.Hour, false},
+	}
+	var b bucket
+	for _, tt := range tests {
+		if got := b.take(limit, start.Add(tt.after)); got != tt.want {
+			t.Errorf("%s: take = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
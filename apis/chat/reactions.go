@@ -0,0 +1,224 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxEmojiBytes       = 32 // room for ZWJ sequences, skin tones and flags
+	maxReactionsPerUser = 10 // distinct emoji one user may put on a single message
+)
+
+var (
+	ErrReactionNotAllowed = errors.New("message not found, deleted, or not in one of your conversations")
+	ErrTooManyReactions   = fmt.Errorf("at most %d reactions per message", maxReactionsPerUser)
+)
+
+// ReactionCount aggregates one emoji on a message. UserIDs lets each participant tell
+// whether they are among the reactors.
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	UserIDs []int  `json:"user_ids"`
+}
+
+// validEmoji accepts a single emoji, including multi-codepoint sequences. It rejects text:
+// letters, spaces and controls, and ASCII other than the digits, # and * of keycaps.
+func validEmoji(s string) bool {
+	if s == "" || len(s) > maxEmojiBytes || !utf8.ValidString(s) {
+		return false
+	}
+	keycap := strings.ContainsRune(s, '⃣')
+	for _, r := range s {
+		switch {
+		case r < utf8.RuneSelf:
+			if !keycap || !(unicode.IsDigit(r) || r == '#' || r == '*') {
+				return false
+			}
+		case unicode.IsLetter(r), unicode.IsSpace(r), unicode.IsControl(r):
+			return false
+		}
+	}
+	return true
+}
+
+// reactionParticipants returns the two users of a direct message userID may react to.
+func reactionParticipants(db *sql.DB, messageID int64, userID int) (from, to int, err error) {
+	var deleted bool
+	query := `SELECT sender_id, receiver_id, deleted_at IS NOT NULL FROM messages WHERE id = ?`
+	err = db.QueryRow(query, messageID).Scan(&from, &to, &deleted)
+	if err == sql.ErrNoRows || (err == nil && (deleted || (userID != from && userID != to))) {
+		return 0, 0, ErrReactionNotAllowed
+	}
+	return from, to, err
+}
+
+// AddReaction records userID's emoji on a message. Adding one that is already there is a no-op.
+func AddReaction(db *sql.DB, messageID int64, userID int, emoji string, at time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int
+	var exists bool
+	query := `SELECT COUNT(*), COALESCE(MAX(emoji = ?), 0) FROM message_reactions WHERE message_id = ? AND user_id = ?`
+	if err := tx.QueryRow(query, emoji, messageID, userID).Scan(&count, &exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	if count >= maxReactionsPerUser {
+		return ErrTooManyReactions
+	}
+	query = `INSERT INTO message_reactions (message_id, user_id, emoji, created_at) VALUES (?, ?, ?, ?)`
+	if _, err := tx.Exec(query, messageID, userID, emoji, at); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveReaction takes userID's emoji off a message; removing one that is not there is a no-op.
+func RemoveReaction(db *sql.DB, messageID int64, userID int, emoji string) error {
+	_, err := db.Exec(`DELETE FROM message_reactions WHERE message_id = ? AND user_id = ? AND emoji = ?`, messageID, userID, emoji)
+	return err
+}
+
+// deleteReactions removes every reaction on the given messages.
+func deleteReactions(db *sql.DB, messageIDs ...int64) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+	placeholders := make([]string, len(messageIDs))
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	_, err := db.Exec(`DELETE FROM message_reactions WHERE message_id IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	return err
+}
+
+// loadReactions fills in the aggregated reactions of messages, each emoji in the order it
+// was first used.
+func loadReactions(db *sql.DB, messages []Frontend) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	byMessage := make(map[int64]*Frontend, len(messages))
+	placeholders := make([]string, 0, len(messages))
+	args := make([]interface{}, 0, len(messages))
+	for i := range messages {
+		byMessage[messages[i].ID] = &messages[i]
+		placeholders = append(placeholders, "?")
+		args = append(args, messages[i].ID)
+	}
+
+	query := `SELECT message_id, emoji, user_id FROM message_reactions
+	          WHERE message_id IN (` + strings.Join(placeholders, ", ") + `)
+	          ORDER BY created_at, user_id`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID int64
+		var emoji string
+		var userID int
+		if err := rows.Scan(&messageID, &emoji, &userID); err != nil {
+			return err
+		}
+		if msg, ok := byMessage[messageID]; ok {
+			msg.Reactions = addReactor(msg.Reactions, emoji, userID)
+		}
+	}
+	return rows.Err()
+}
+
+func addReactor(counts []ReactionCount, emoji string, userID int) []ReactionCount {
+	for i := range counts {
+		if counts[i].Emoji == emoji {
+			counts[i].Count++
+			counts[i].UserIDs = append(counts[i].UserIDs, userID)
+			return counts
+		}
+	}
+	return append(counts, ReactionCount{Emoji: emoji, Count: 1, UserIDs: []int{userID}})
+}
+
+// GetReactions returns the aggregated reactions on one message.
+func GetReactions(db *sql.DB, messageID int64) ([]ReactionCount, error) {
+	messages := []Frontend{{ID: messageID}}
+	if err := loadReactions(db, messages); err != nil {
+		return nil, err
+	}
+	if messages[0].Reactions == nil {
+		return []ReactionCount{}, nil
+	}
+	return messages[0].Reactions, nil
+}
+
+// handleReaction adds or removes c's user's emoji on a direct message and sends the new
+// totals to every device of both participants, the reacting one included.
+func (h *Hub) handleReaction(c *Client, msg Frontend) {
+	if msg.ID <= 0 {
+		c.sendError(msg, ErrCodeInvalid, "id is required.")
+		return
+	}
+	if !validEmoji(msg.Emoji) {
+		c.sendError(msg, ErrCodeInvalid, "emoji must be a single emoji.")
+		return
+	}
+
+	from, to, err := reactionParticipants(h.DB, msg.ID, c.UserID)
+	if err == nil {
+		var blocked bool
+		if blocked, err = IsBlocked(h.DB, from, to); err == nil && blocked {
+			err = ErrReactionNotAllowed
+		}
+	}
+	now := time.Now().UTC()
+	if err == nil {
+		if msg.Type == TypeReact {
+			err = AddReaction(h.DB, msg.ID, c.UserID, msg.Emoji, now)
+		} else {
+			err = RemoveReaction(h.DB, msg.ID, c.UserID, msg.Emoji)
+		}
+	}
+	if errors.Is(err, ErrReactionNotAllowed) {
+		c.sendError(msg, ErrCodeForbidden, "You cannot react to that message.")
+		return
+	}
+	if errors.Is(err, ErrTooManyReactions) {
+		c.sendError(msg, ErrCodeInvalid, fmt.Sprintf("You can add at most %d reactions to a message.", maxReactionsPerUser))
+		return
+	}
+	if err != nil {
+		fmt.Println("Error updating reaction:", err)
+		c.sendError(msg, ErrCodeInternal, "The reaction could not be saved.")
+		return
+	}
+
+	reactions, err := GetReactions(h.DB, msg.ID)
+	if err != nil {
+		fmt.Println("Error loading reactions:", err)
+		return
+	}
+	c.ack(msg.ClientID, Frontend{ID: msg.ID, From: from, To: to}, now)
+
+	event := Frontend{Type: TypeReaction, ID: msg.ID, From: c.UserID, Emoji: msg.Emoji, Reactions: reactions, Timestamp: now}
+	h.sendToUser(from, event)
+	if to != from {
+		h.sendToUser(to, event)
+	}
+}
@@ -0,0 +1,88 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type UnreadCount struct {
+	UserID int `json:"user_id"`
+	Unread int `json:"unread"`
+}
+
+// MarkDelivered stamps a single message as delivered to its receiver.
+func MarkDelivered(db *sql.DB, messageID int64, at time.Time) error {
+	query := `UPDATE messages SET delivered_at = ? WHERE id = ? AND delivered_at IS NULL`
+	_, err := db.Exec(query, at, messageID)
+	return err
+}
+
+// MarkRead stamps every message from senderID to readerID up to and including upTo as read.
+// An upTo of zero marks the whole conversation.
+func MarkRead(db *sql.DB, readerID, senderID int, upTo int64, at time.Time) (int64, error) {
+	query := `UPDATE messages SET read_at = ?, delivered_at = COALESCE(delivered_at, ?)
+	          WHERE receiver_id = ? AND sender_id = ? AND read_at IS NULL AND (? = 0 OR id <= ?)`
+	result, err := db.Exec(query, at, at, readerID, senderID, upTo, upTo)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetUnreadCounts returns the number of unread messages per sender for the given receiver.
+func GetUnreadCounts(db *sql.DB, userID int) ([]UnreadCount, error) {
+	query := `SELECT sender_id, COUNT(*) FROM messages
+	          WHERE receiver_id = ? AND read_at IS NULL AND deleted_at IS NULL
+	          GROUP BY sender_id`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []UnreadCount{}
+	for rows.Next() {
+		var c UnreadCount
+		if err := rows.Scan(&c.UserID, &c.Unread); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// markDeliveredIfOnline records delivery of a freshly saved message and tells the sender about it.
+func (h *Hub) markDeliveredIfOnline(msg *Frontend) {
+	if msg.ID == 0 || !h.isOnline(msg.To) {
+		return
+	}
+	now := time.Now().UTC()
+	if err := MarkDelivered(h.DB, msg.ID, now); err != nil {
+		fmt.Println("Error marking message delivered:", err)
+		return
+	}
+	msg.DeliveredAt = &now
+	h.sendToUser(msg.From, Frontend{Type: "delivered", ID: msg.ID, From: msg.To, To: msg.From, Timestamp: now})
+}
+
+// handleRead marks the conversation as read by c's user and relays the receipt to the other participant.
+func (h *Hub) handleRead(c *Client, msg Frontend) {
+	if msg.To <= 0 {
+		return
+	}
+	now := time.Now().UTC()
+	updated, err := MarkRead(h.DB, c.UserID, msg.To, msg.ID, now)
+	if err != nil {
+		fmt.Println("Error marking messages read:", err)
+		return
+	}
+	if updated == 0 {
+		return
+	}
+
+	receipt := Frontend{Type: "read", ID: msg.ID, From: c.UserID, To: msg.To, Timestamp: now, origin: c}
+	h.sendToUser(msg.To, receipt)
+	h.sendToUser(c.UserID, receipt)
+	h.pushConversationUpdate(c.UserID, msg.To)
+}
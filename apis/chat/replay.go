@@ -0,0 +1,149 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	replayBatchSize     = 100
+	maxHeldDuringReplay = 4 * sendQueueSize // live frames kept aside while a backlog is replayed
+)
+
+// parseLastSeen reads a message ID the client already has from the query string; zero means "none".
+func parseLastSeen(value string) int64 {
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0
+	}
+	return id
+}
+
+// GetDirectMessagesAfter returns up to limit messages sent or received by the user with an ID above afterID, oldest first.
+func GetDirectMessagesAfter(db *sql.DB, userID int, afterID int64, limit int) ([]Frontend, error) {
+	query := `SELECT ` + messageColumns + ` FROM messages
+	          WHERE (sender_id = ? OR receiver_id = ?) AND id > ?
+	          ORDER BY id ASC LIMIT ?`
+	return queryMessages(db, query, userID, userID, afterID, limit)
+}
+
+// GetRoomMessagesAfter returns up to limit messages from the user's rooms with an ID above afterID, oldest first.
+func GetRoomMessagesAfter(db *sql.DB, userID int, afterID int64, limit int) ([]Frontend, error) {
+	query := `SELECT rm.id, rm.sender_id, rm.room_id, rm.content, rm.created_at FROM room_messages rm
+	          JOIN chat_room_members m ON m.room_id = rm.room_id AND m.user_id = ?
+	          WHERE rm.id > ? AND rm.id > m.visible_after_id
+	          ORDER BY rm.id ASC LIMIT ?`
+	rows, err := db.Query(query, userID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Frontend{}
+	for rows.Next() {
+		m := Frontend{Type: "room_message"}
+		if err := rows.Scan(&m.ID, &m.From, &m.RoomID, &m.Content, &m.Timestamp); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// errQueueClosed stops a replay once the hub has let go of the client.
+var errQueueClosed = errors.New("send queue closed")
+
+// replayMissed writes everything the client missed since its last-seen IDs straight to the
+// connection, before writePump starts draining live traffic. Live frames that arrive
+// meanwhile are moved out of Send into held after every write, so a long backlog does not
+// fill the queue and get the client dropped as too slow; writePump sends them next. It
+// returns the highest IDs it replayed so live copies of the same messages can be skipped.
+func (c *Client) replayMissed(hub *Hub) (lastDM, lastRoom int64, held []Frontend, err error) {
+	lastDM, lastRoom = c.LastSeen, c.LastSeenRoom
+
+	write := func(msg Frontend) error {
+		if err := c.write(msg); err != nil {
+			return err
+		}
+		for {
+			select {
+			case live, ok := <-c.Send:
+				if !ok {
+					return errQueueClosed
+				}
+				if len(held) >= maxHeldDuringReplay {
+					return fmt.Errorf("more than %d live frames arrived during replay", maxHeldDuringReplay)
+				}
+				held = append(held, live)
+			default:
+				return nil
+			}
+		}
+	}
+
+	for c.LastSeen > 0 {
+		batch, err := GetDirectMessagesAfter(hub.DB, c.UserID, lastDM, replayBatchSize)
+		if err != nil {
+			return lastDM, lastRoom, held, err
+		}
+		for _, msg := range batch {
+			if msg.To == c.UserID && msg.From != c.UserID && msg.DeliveredAt == nil {
+				hub.acknowledgeReplayed(&msg)
+			}
+			if err := write(msg); err != nil {
+				return lastDM, lastRoom, held, err
+			}
+			lastDM = msg.ID
+		}
+		if len(batch) < replayBatchSize {
+			break
+		}
+	}
+
+	for c.LastSeenRoom > 0 {
+		batch, err := GetRoomMessagesAfter(hub.DB, c.UserID, lastRoom, replayBatchSize)
+		if err != nil {
+			return lastDM, lastRoom, held, err
+		}
+		for _, msg := range batch {
+			if err := write(msg); err != nil {
+				return lastDM, lastRoom, held, err
+			}
+			lastRoom = msg.ID
+		}
+		if len(batch) < replayBatchSize {
+			break
+		}
+	}
+
+	if c.LastSeen > 0 || c.LastSeenRoom > 0 {
+		err = write(Frontend{Type: "resumed", To: c.UserID, Timestamp: time.Now().UTC()})
+	}
+	return lastDM, lastRoom, held, err
+}
+
+// acknowledgeReplayed marks a message that reached its receiver after it was saved, by
+// replay or through another instance, as delivered and lets the sender know.
+func (h *Hub) acknowledgeReplayed(msg *Frontend) {
+	now := time.Now().UTC()
+	if err := MarkDelivered(h.DB, msg.ID, now); err != nil {
+		fmt.Println("Error marking replayed message delivered:", err)
+		return
+	}
+	msg.DeliveredAt = &now
+	h.sendToUser(msg.From, Frontend{Type: "delivered", ID: msg.ID, From: msg.To, To: msg.From, Timestamp: now})
+}
+
+// alreadyReplayed reports whether a live frame duplicates one replayMissed has written.
+func alreadyReplayed(msg Frontend, lastDM, lastRoom int64) bool {
+	switch msg.Type {
+	case "message":
+		return msg.ID > 0 && msg.ID <= lastDM
+	case "room_message":
+		return msg.ID > 0 && msg.ID <= lastRoom
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+const replyPreviewLength = 120 // characters of the parent shown above a reply
+
+var ErrInvalidReply = errors.New("reply_to must be a message in the same conversation that has not been deleted")
+
+// ReplyPreview is the quoted parent of a reply. A parent that has since been deleted or
+// purged is a tombstone: only its ID and Deleted are set.
+type ReplyPreview struct {
+	ID        int64  `json:"id"`
+	From      int    `json:"from,omitempty"`
+	Content   string `json:"content,omitempty"`
+	Encrypted bool   `json:"encrypted,omitempty"` // content is withheld; only the participants' browsers can read it
+	Deleted   bool   `json:"deleted,omitempty"`
+}
+
+func newReplyPreview(id int64, from int, content string, encrypted, deleted bool) *ReplyPreview {
+	if deleted {
+		return &ReplyPreview{ID: id, Deleted: true}
+	}
+	preview := &ReplyPreview{ID: id, From: from, Encrypted: encrypted}
+	if !encrypted {
+		preview.Content = truncate(content, replyPreviewLength)
+	}
+	return preview
+}
+
+func truncate(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// replyPreview checks the parent a new direct message answers and returns its preview.
+func replyPreview(db *sql.DB, msg Frontend) (*ReplyPreview, error) {
+	if msg.ReplyTo == 0 {
+		return nil, nil
+	}
+	var from int
+	var content string
+	var encrypted, deleted bool
+	query := `SELECT sender_id, content, encrypted, deleted_at IS NOT NULL FROM messages
+	          WHERE id = ? AND ((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?))`
+	err := db.QueryRow(query, msg.ReplyTo, msg.From, msg.To, msg.To, msg.From).Scan(&from, &content, &encrypted, &deleted)
+	if err == sql.ErrNoRows || (err == nil && deleted) {
+		return nil, ErrInvalidReply
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newReplyPreview(msg.ReplyTo, from, content, encrypted, false), nil
+}
+
+// loadReplyPreviews fills in the parents quoted by messages that are replies.
+func loadReplyPreviews(db *sql.DB, messages []Frontend) error {
+	var placeholders []string
+	var args []interface{}
+	for _, m := range messages {
+		if m.ReplyTo > 0 {
+			placeholders = append(placeholders, "?")
+			args = append(args, m.ReplyTo)
+		}
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	query := `SELECT id, sender_id, content, encrypted, deleted_at IS NOT NULL FROM messages
+	          WHERE id IN (` + strings.Join(placeholders, ", ") + `)`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	parents := make(map[int64]*ReplyPreview)
+	for rows.Next() {
+		var id int64
+		var from int
+		var content string
+		var encrypted, deleted bool
+		if err := rows.Scan(&id, &from, &content, &encrypted, &deleted); err != nil {
+			return err
+		}
+		parents[id] = newReplyPreview(id, from, content, encrypted, deleted)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range messages {
+		if id := messages[i].ReplyTo; id > 0 {
+			if parent, ok := parents[id]; ok {
+				messages[i].ReplyPreview = parent
+			} else {
+				messages[i].ReplyPreview = &ReplyPreview{ID: id, Deleted: true} // purged
+			}
+		}
+	}
+	return nil
+}
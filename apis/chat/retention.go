@@ -0,0 +1,350 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	e "forum/apis/error"
+	u "forum/apis/user"
+)
+
+const (
+	purgeInterval  = 15 * time.Second
+	purgeBatchSize = 500
+
+	minTimer = time.Minute
+	maxTimer = 90 * 24 * time.Hour
+)
+
+var ErrInvalidTimer = errors.New("timer must be 0 (off) or between one minute and 90 days")
+
+// retentionFromEnv reads FORUM_MESSAGE_RETENTION, the maximum age of any message, as a Go
+// duration ("720h") or a number of days ("30d"). Unset or zero keeps messages forever.
+func retentionFromEnv() time.Duration {
+	value := strings.TrimSpace(os.Getenv("FORUM_MESSAGE_RETENTION"))
+	if value == "" {
+		return 0
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return time.Duration(n) * 24 * time.Hour
+		}
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		fmt.Printf("Ignoring FORUM_MESSAGE_RETENTION=%q; expected e.g. \"720h\" or \"30d\"\n", value)
+		return 0
+	}
+	return d
+}
+
+// GetTimer returns the disappearing-message timer of the conversation between a and b, or zero.
+func GetTimer(db *sql.DB, a, b int) (time.Duration, error) {
+	if a > b {
+		a, b = b, a
+	}
+	var seconds int64
+	err := db.QueryRow(`SELECT seconds FROM conversation_timers WHERE user_a = ? AND user_b = ?`, a, b).Scan(&seconds)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return time.Duration(seconds) * time.Second, err
+}
+
+// SetTimer changes the conversation's timer for messages sent from now on; zero turns it off.
+func SetTimer(db *sql.DB, setBy, peerID int, timer time.Duration) error {
+	if timer != 0 && (timer < minTimer || timer > maxTimer) {
+		return ErrInvalidTimer
+	}
+	a, b := setBy, peerID
+	if a > b {
+		a, b = b, a
+	}
+	if timer == 0 {
+		_, err := db.Exec(`DELETE FROM conversation_timers WHERE user_a = ? AND user_b = ?`, a, b)
+		return err
+	}
+	query := `INSERT INTO conversation_timers (user_a, user_b, seconds, set_by, updated_at) VALUES (?, ?, ?, ?, ?)
+	          ON CONFLICT (user_a, user_b) DO UPDATE SET seconds = excluded.seconds, set_by = excluded.set_by, updated_at = excluded.updated_at`
+	_, err := db.Exec(query, a, b, int64(timer/time.Second), setBy, time.Now().UTC())
+	return err
+}
+
+// stampExpiry sets when a new direct message disappears, if its conversation has a timer.
+func (h *Hub) stampExpiry(msg *Frontend) {
+	timer, err := GetTimer(h.DB, msg.From, msg.To)
+	if err != nil {
+		fmt.Println("Error loading conversation timer:", err)
+		return
+	}
+	if timer > 0 {
+		expiresAt := msg.Timestamp.Add(timer)
+		msg.ExpiresAt = &expiresAt
+	}
+}
+
+// TimerHandler serves /conversations/timer: GET ?with= shows the timer, POST {"user_id", "seconds"}
+// changes it and tells both participants.
+func TimerHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	userID, loggedIn := u.ValidateSession(hub.DB, r)
+	if !loggedIn {
+		http.Error(w, "Unauthorized. Please log in.", http.StatusUnauthorized)
+		return
+	}
+
+	var peerID int
+	switch r.Method {
+	case http.MethodGet:
+		peerID, _ = strconv.Atoi(r.URL.Query().Get("with"))
+	case http.MethodPost:
+		var req struct {
+			UserID  int   `json:"user_id"`
+			Seconds int64 `json:"seconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID <= 0 {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		peerID = req.UserID
+		names, err := usernames(hub.DB, peerID)
+		if err != nil {
+			fmt.Println(" Error loading username:", err)
+			e.ErrorHandler(w, r, 500)
+			return
+		}
+		if names[peerID] == "" {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		blocked, err := IsBlocked(hub.DB, userID, peerID)
+		if err != nil {
+			fmt.Println(" Error checking block:", err)
+			e.ErrorHandler(w, r, 500)
+			return
+		}
+		if blocked {
+			http.Error(w, "You cannot change this conversation", http.StatusForbidden)
+			return
+		}
+		err = SetTimer(hub.DB, userID, peerID, time.Duration(req.Seconds)*time.Second)
+		if errors.Is(err, ErrInvalidTimer) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			fmt.Println(" Error setting conversation timer:", err)
+			e.ErrorHandler(w, r, 500)
+			return
+		}
+		changed := Frontend{Type: "timer_changed", From: userID, To: peerID, TTL: req.Seconds, Timestamp: time.Now().UTC()}
+		hub.sendToUser(peerID, changed)
+		if peerID != userID {
+			hub.sendToUser(userID, changed)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if peerID <= 0 {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	timer, err := GetTimer(hub.DB, userID, peerID)
+	if err != nil {
+		e.ErrorHandler(w, r, 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"user_id": peerID, "seconds": int64(timer / time.Second)})
+}
+
+type expiredMessage struct {
+	id       int64
+	from, to int // direct messages
+	roomID   int // room messages
+}
+
+// purgeExpired runs for the life of the hub, deleting messages past their timer or past the
+// global retention age and telling connected participants to drop them.
+func (h *Hub) purgeExpired() {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now().UTC()
+		for {
+			n, err := h.purgeDirectBatch(now)
+			if err != nil {
+				fmt.Println("Error purging expired messages:", err)
+			}
+			if err != nil || n < purgeBatchSize {
+				break
+			}
+		}
+		if h.Retention > 0 {
+			for {
+				n, err := h.purgeRoomBatch(now.Add(-h.Retention))
+				if err != nil {
+					fmt.Println("Error purging old room messages:", err)
+				}
+				if err != nil || n < purgeBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+func (h *Hub) purgeDirectBatch(now time.Time) (int, error) {
+	cutoff := time.Time{}
+	if h.Retention > 0 {
+		cutoff = now.Add(-h.Retention)
+	}
+	query := `SELECT id, sender_id, receiver_id FROM messages
+	          WHERE expires_at <= ? OR created_at < ?
+	          LIMIT ?`
+	expired, err := h.selectExpired(query, now, cutoff, purgeBatchSize)
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+
+	ids := make([]int64, len(expired))
+	for i, m := range expired {
+		ids[i] = m.id
+	}
+	if err := deleteAttachments(h.DB, ids...); err != nil {
+		return 0, err
+	}
+	if err := deleteReactions(h.DB, ids...); err != nil {
+		return 0, err
+	}
+	if err := deleteByID(h.DB, "messages", ids); err != nil {
+		return 0, err
+	}
+
+	byPair := make(map[string][]expiredMessage)
+	for _, m := range expired {
+		key := chatKey(m.from, m.to)
+		byPair[key] = append(byPair[key], m)
+	}
+	for key, messages := range byPair {
+		pairIDs := h.forgetStored(key, messages)
+		a, b := messages[0].from, messages[0].to
+		notice := Frontend{Type: "messages_expired", IDs: pairIDs, Timestamp: now}
+		for _, userID := range []int{a, b} {
+			notice.To = userID
+			h.sendToUser(userID, notice)
+			h.pushConversationUpdate(userID, a+b-userID)
+			if a == b {
+				break
+			}
+		}
+	}
+	return len(expired), nil
+}
+
+func (h *Hub) purgeRoomBatch(cutoff time.Time) (int, error) {
+	query := `SELECT id, room_id FROM room_messages WHERE created_at < ? LIMIT ?`
+	rows, err := h.DB.Query(query, cutoff, purgeBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var expired []expiredMessage
+	for rows.Next() {
+		var m expiredMessage
+		if err := rows.Scan(&m.id, &m.roomID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, m)
+	}
+	rows.Close()
+	if len(expired) == 0 {
+		return 0, rows.Err()
+	}
+
+	ids := make([]int64, len(expired))
+	byRoom := make(map[int][]expiredMessage)
+	for i, m := range expired {
+		ids[i] = m.id
+		byRoom[m.roomID] = append(byRoom[m.roomID], m)
+	}
+	if err := deleteByID(h.DB, "room_messages", ids); err != nil {
+		return 0, err
+	}
+	for roomID, messages := range byRoom {
+		roomIDs := h.forgetStored(roomKey(roomID), messages)
+		members, err := RoomMemberIDs(h.DB, roomID)
+		if err != nil {
+			fmt.Println("Error loading room members:", err)
+			continue
+		}
+		for _, userID := range members {
+			h.sendToUser(userID, Frontend{Type: "messages_expired", To: userID, RoomID: roomID, IDs: roomIDs, Timestamp: cutoff})
+		}
+	}
+	return len(expired), nil
+}
+
+func (h *Hub) selectExpired(query string, args ...interface{}) ([]expiredMessage, error) {
+	rows, err := h.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expired []expiredMessage
+	for rows.Next() {
+		var m expiredMessage
+		if err := rows.Scan(&m.id, &m.from, &m.to); err != nil {
+			return nil, err
+		}
+		expired = append(expired, m)
+	}
+	return expired, rows.Err()
+}
+
+// deleteByID removes rows of a message table by ID; table is always one of our own constants.
+func deleteByID(db *sql.DB, table string, ids []int64) error {
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	_, err := db.Exec(`DELETE FROM `+table+` WHERE id IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	return err
+}
+
+// forgetStored drops purged messages from the in-memory store and returns their IDs.
+func (h *Hub) forgetStored(key string, messages []expiredMessage) []int64 {
+	gone := make(map[int64]bool, len(messages))
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		gone[m.id] = true
+		ids[i] = m.id
+	}
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	kept := h.MessageStore[key][:0]
+	for _, stored := range h.MessageStore[key] {
+		if !gone[stored.ID] {
+			kept = append(kept, stored)
+		}
+	}
+	if len(kept) == 0 {
+		delete(h.MessageStore, key)
+	} else {
+		h.MessageStore[key] = kept
+	}
+	return ids
+}
@@ -0,0 +1,34 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"   ", 0},
+		{"0", 0},
+		{"720h", 720 * time.Hour},
+		{"90m", 90 * time.Minute},
+		{"30d", 30 * 24 * time.Hour},
+		{" 7d ", 7 * 24 * time.Hour},
+		{"0d", 0},
+		{"-1h", 0},
+		{"-3d", 0},
+		{"soon", 0},
+		{"1.5d", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("FORUM_MESSAGE_RETENTION", tt.value)
+			if got := retentionFromEnv(); got != tt.want {
+				t.Errorf("retentionFromEnv() with %q = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,373 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Room struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy int       `json:"created_by"`
+	Members   []int     `json:"members"`
+	CreatedAt time.Time `json:"created_at"`
+	InvitedBy int       `json:"invited_by,omitempty"` // set on pending invitations
+}
+
+func roomKey(roomID int) string {
+	return fmt.Sprintf("room-%d", roomID)
+}
+
+var (
+	ErrInvalidRoomMember = errors.New("room members must be existing users who have not blocked you or been blocked by you")
+	ErrNotRoomMember     = errors.New("not a member of this room")
+	ErrNoRoomInvite      = errors.New("no invitation to this room")
+)
+
+// checkRoomInvitees makes sure inviterID may bring each user into a room: the user exists
+// and neither has blocked the other.
+func checkRoomInvitees(db *sql.DB, inviterID int, userIDs []int) error {
+	for _, userID := range userIDs {
+		if userID == inviterID {
+			continue
+		}
+		names, err := usernames(db, userID)
+		if err != nil {
+			return err
+		}
+		if names[userID] == "" {
+			return ErrInvalidRoomMember
+		}
+		blocked, err := IsBlocked(db, inviterID, userID)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return ErrInvalidRoomMember
+		}
+	}
+	return nil
+}
+
+// addRoomMember adds a user to a room; they see only the messages sent from now on.
+func addRoomMember(tx *sql.Tx, roomID, userID int) error {
+	query := `INSERT OR IGNORE INTO chat_room_members (room_id, user_id, visible_after_id)
+	          VALUES (?, ?, (SELECT COALESCE(MAX(id), 0) FROM room_messages WHERE room_id = ?))`
+	_, err := tx.Exec(query, roomID, userID, roomID)
+	return err
+}
+
+// CreateRoom stores a new room and adds the creator plus the given members to it.
+func CreateRoom(db *sql.DB, name string, creatorID int, members []int) (int, error) {
+	if err := checkRoomInvitees(db, creatorID, members); err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO chat_rooms (name, created_by) VALUES (?, ?)`, name, creatorID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, userID := range append([]int{creatorID}, members...) {
+		if userID <= 0 {
+			continue
+		}
+		if err := addRoomMember(tx, int(id), userID); err != nil {
+			return 0, err
+		}
+	}
+
+	return int(id), tx.Commit()
+}
+
+// InviteToRoom lets a member invite users into the room. It returns the users who were
+// invited; those already in the room are skipped.
+func InviteToRoom(db *sql.DB, roomID, inviterID int, userIDs []int, at time.Time) ([]int, error) {
+	isMember, err := IsRoomMember(db, roomID, inviterID)
+	if err != nil {
+		return nil, err
+	}
+	if !isMember {
+		return nil, ErrNotRoomMember
+	}
+	if err := checkRoomInvitees(db, inviterID, userIDs); err != nil {
+		return nil, err
+	}
+
+	var invited []int
+	for _, userID := range userIDs {
+		if userID <= 0 {
+			continue
+		}
+		member, err := IsRoomMember(db, roomID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if member {
+			continue
+		}
+		query := `INSERT OR IGNORE INTO chat_room_invites (room_id, user_id, invited_by, created_at) VALUES (?, ?, ?, ?)`
+		if _, err := db.Exec(query, roomID, userID, inviterID, at); err != nil {
+			return nil, err
+		}
+		invited = append(invited, userID)
+	}
+	return invited, nil
+}
+
+// JoinRoom accepts the user's invitation to a room.
+func JoinRoom(db *sql.DB, roomID, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM chat_room_invites WHERE room_id = ? AND user_id = ?`, roomID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return ErrNoRoomInvite
+	}
+	if err := addRoomMember(tx, roomID, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetRoomInvites returns the rooms the user has been invited to but not yet joined.
+func GetRoomInvites(db *sql.DB, userID int) ([]Room, error) {
+	query := `SELECT r.id, r.name, r.created_by, r.created_at, i.invited_by FROM chat_rooms r
+	          JOIN chat_room_invites i ON i.room_id = r.id
+	          WHERE i.user_id = ?
+	          ORDER BY i.created_at`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []Room{}
+	for rows.Next() {
+		var room Room
+		if err := rows.Scan(&room.ID, &room.Name, &room.CreatedBy, &room.CreatedAt, &room.InvitedBy); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func LeaveRoom(db *sql.DB, roomID, userID int) error {
+	_, err := db.Exec(`DELETE FROM chat_room_members WHERE room_id = ? AND user_id = ?`, roomID, userID)
+	return err
+}
+
+func IsRoomMember(db *sql.DB, roomID, userID int) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM chat_room_members WHERE room_id = ? AND user_id = ?`, roomID, userID).Scan(&count)
+	return count > 0, err
+}
+
+func RoomMemberIDs(db *sql.DB, roomID int) ([]int, error) {
+	rows, err := db.Query(`SELECT user_id FROM chat_room_members WHERE room_id = ? ORDER BY joined_at`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetRoomsForUser returns every room the user belongs to, with its member list.
+func GetRoomsForUser(db *sql.DB, userID int) ([]Room, error) {
+	query := `SELECT r.id, r.name, r.created_by, r.created_at FROM chat_rooms r
+	          JOIN chat_room_members m ON m.room_id = r.id
+	          WHERE m.user_id = ?
+	          ORDER BY r.name`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []Room{}
+	for rows.Next() {
+		var room Room
+		if err := rows.Scan(&room.ID, &room.Name, &room.CreatedBy, &room.CreatedAt); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range rooms {
+		members, err := RoomMemberIDs(db, rooms[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		rooms[i].Members = members
+	}
+	return rooms, nil
+}
+
+func (h *Hub) saveRoomMessageToDB(msg Frontend) (int64, error) {
+	query := `INSERT INTO room_messages (room_id, sender_id, content, created_at, client_id) VALUES (?, ?, ?, ?, ?)`
+	result, err := h.DB.Exec(query, msg.RoomID, msg.From, msg.Content, msg.Timestamp, nullableClientID(msg.ClientID))
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// broadcastToRoom stores a room message and fans it out to every online member's devices.
+func (h *Hub) broadcastToRoom(msg Frontend) {
+	isMember, err := IsRoomMember(h.DB, msg.RoomID, msg.From)
+	if err != nil || !isMember {
+		if msg.origin != nil {
+			msg.origin.sendError(msg, ErrCodeForbidden, "You are not a member of this room.")
+		}
+		return
+	}
+
+	id, createdAt, duplicate, err := findByClientID(h.DB, "room_messages", msg.From, msg.ClientID)
+	if err != nil {
+		fmt.Println("Error checking for a resent room message:", err)
+	}
+	if duplicate {
+		if msg.origin != nil {
+			msg.origin.ack(msg.ClientID, Frontend{ID: id, From: msg.From, RoomID: msg.RoomID}, createdAt)
+		}
+		return
+	}
+
+	id, err = h.saveRoomMessageToDB(msg)
+	if err != nil {
+		fmt.Println("Error saving room message:", err)
+		if msg.origin != nil {
+			msg.origin.sendError(msg, ErrCodeInternal, "The message could not be saved.")
+		}
+		return
+	}
+	msg.ID = id
+	h.meters.messages.mark(time.Now())
+	if msg.origin != nil {
+		msg.origin.ack(msg.ClientID, msg, msg.Timestamp)
+	}
+
+	key := roomKey(msg.RoomID)
+	h.Mutex.Lock()
+	h.MessageStore[key] = append(h.MessageStore[key], msg)
+	h.Mutex.Unlock()
+
+	members, err := RoomMemberIDs(h.DB, msg.RoomID)
+	if err != nil {
+		fmt.Println("Error loading room members:", err)
+		return
+	}
+	for _, id := range members {
+		h.sendToUser(id, msg)
+	}
+}
+
+// notifyRoom sends a room control event to every online member of the room.
+func (h *Hub) notifyRoom(roomID int, msg Frontend) {
+	members, err := RoomMemberIDs(h.DB, roomID)
+	if err != nil {
+		fmt.Println("Error loading room members:", err)
+		return
+	}
+	msg.Members = members
+
+	for _, id := range members {
+		h.sendToUser(id, msg)
+	}
+}
+
+func (h *Hub) handleRoomControl(c *Client, msg Frontend) {
+	now := time.Now().UTC()
+	switch msg.Type {
+	case "create_room":
+		name := strings.TrimSpace(msg.Content)
+		if name == "" {
+			c.sendError(msg, ErrCodeInvalid, "Room name cannot be empty.")
+			return
+		}
+		roomID, err := CreateRoom(h.DB, name, c.UserID, msg.Members)
+		if errors.Is(err, ErrInvalidRoomMember) {
+			c.sendError(msg, ErrCodeInvalid, "Members must be existing users who have not blocked you.")
+			return
+		}
+		if err != nil {
+			fmt.Println("Error creating room:", err)
+			c.sendError(msg, ErrCodeInternal, "The room could not be created.")
+			return
+		}
+		h.notifyRoom(roomID, Frontend{Type: "room_created", From: c.UserID, RoomID: roomID, Content: name, Timestamp: now})
+	case "invite_room":
+		invited, err := InviteToRoom(h.DB, msg.RoomID, c.UserID, msg.Members, now)
+		if errors.Is(err, ErrNotRoomMember) {
+			c.sendError(msg, ErrCodeForbidden, "Only members can invite people to this room.")
+			return
+		}
+		if errors.Is(err, ErrInvalidRoomMember) {
+			c.sendError(msg, ErrCodeInvalid, "You can only invite existing users who have not blocked you.")
+			return
+		}
+		if err != nil {
+			fmt.Println("Error inviting to room:", err)
+			c.sendError(msg, ErrCodeInternal, "The invitations could not be sent.")
+			return
+		}
+		c.ack(msg.ClientID, Frontend{From: c.UserID, RoomID: msg.RoomID}, now)
+		var name string
+		h.DB.QueryRow(`SELECT name FROM chat_rooms WHERE id = ?`, msg.RoomID).Scan(&name)
+		for _, userID := range invited {
+			h.sendToUser(userID, Frontend{Type: "room_invited", From: c.UserID, To: userID, RoomID: msg.RoomID, Content: name, Timestamp: now})
+		}
+	case "join_room":
+		err := JoinRoom(h.DB, msg.RoomID, c.UserID)
+		if errors.Is(err, ErrNoRoomInvite) {
+			c.sendError(msg, ErrCodeForbidden, "You need an invitation from a member to join this room.")
+			return
+		}
+		if err != nil {
+			fmt.Println("Error joining room:", err)
+			c.sendError(msg, ErrCodeInternal, "The room could not be joined.")
+			return
+		}
+		h.notifyRoom(msg.RoomID, Frontend{Type: "room_joined", From: c.UserID, RoomID: msg.RoomID, Timestamp: now})
+	case "leave_room":
+		if err := LeaveRoom(h.DB, msg.RoomID, c.UserID); err != nil {
+			fmt.Println("Error leaving room:", err)
+			c.sendError(msg, ErrCodeInternal, "The room could not be left.")
+			return
+		}
+		left := Frontend{Type: "room_left", From: c.UserID, RoomID: msg.RoomID, Timestamp: now}
+		h.notifyRoom(msg.RoomID, left)
+		h.sendToUser(c.UserID, left)
+	}
+}
@@ -0,0 +1,88 @@
+package chat
+
+import (
+	"database/sql"
+	"html"
+	"strings"
+	"time"
+)
+
+const (
+	maxSearchTerms = 10
+
+	// Private-use markers placed around matches by snippet(); they are swapped for
+	// <mark> tags only after the surrounding text has been HTML-escaped.
+	matchStart = "\uE000"
+	matchEnd   = "\uE001"
+)
+
+type SearchResult struct {
+	ID        int64     `json:"id"`
+	From      int       `json:"from"`
+	To        int       `json:"to"`
+	PeerID    int       `json:"peer_id"`
+	Snippet   string    `json:"snippet"` // HTML-escaped, matches wrapped in <mark>
+	Timestamp time.Time `json:"timestamp"`
+	Cursor    string    `json:"cursor"` // pass as before/after to /messages to load surrounding messages
+	Offset    int       `json:"offset"` // number of newer messages in the same conversation
+}
+
+// buildMatchQuery turns free text into an FTS5 query that matches every term literally,
+// so user input can never be parsed as FTS5 syntax.
+func buildMatchQuery(text string) string {
+	terms := strings.Fields(text)
+	if len(terms) > maxSearchTerms {
+		terms = terms[:maxSearchTerms]
+	}
+	for i, term := range terms {
+		terms[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	return strings.Join(terms, " ")
+}
+
+// SearchMessages finds direct messages matching text in conversations the user took part in,
+// optionally limited to the conversation with peerID, best matches first. End-to-end encrypted
+// messages are never indexed, so they cannot match.
+func SearchMessages(db *sql.DB, userID, peerID int, text string, limit int) ([]SearchResult, error) {
+	results := []SearchResult{}
+	match := buildMatchQuery(text)
+	if match == "" {
+		return results, nil
+	}
+
+	query := `SELECT m.id, m.sender_id, m.receiver_id, m.created_at,
+	                 snippet(messages_fts, 0, ?, ?, '…', 12),
+	                 (SELECT COUNT(*) FROM messages n
+	                  WHERE ((n.sender_id = m.sender_id AND n.receiver_id = m.receiver_id)
+	                      OR (n.sender_id = m.receiver_id AND n.receiver_id = m.sender_id))
+	                    AND (n.created_at > m.created_at OR (n.created_at = m.created_at AND n.id > m.id)))
+	          FROM messages_fts
+	          JOIN messages m ON m.id = messages_fts.rowid
+	          WHERE messages_fts MATCH ?
+	            AND (m.sender_id = ? OR m.receiver_id = ?)
+	            AND (? = 0 OR m.sender_id = ? OR m.receiver_id = ?)
+	            AND m.deleted_at IS NULL
+	            AND m.encrypted = 0
+	          ORDER BY rank
+	          LIMIT ?`
+	rows, err := db.Query(query, matchStart, matchEnd, match, userID, userID, peerID, peerID, peerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r SearchResult
+		if err := rows.Scan(&r.ID, &r.From, &r.To, &r.Timestamp, &r.Snippet, &r.Offset); err != nil {
+			return nil, err
+		}
+		r.PeerID = r.To
+		if r.To == userID {
+			r.PeerID = r.From
+		}
+		r.Snippet = strings.NewReplacer(matchStart, "<mark>", matchEnd, "</mark>").Replace(html.EscapeString(r.Snippet))
+		r.Cursor = EncodeCursor(Cursor{CreatedAt: r.Timestamp, ID: r.ID})
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,30 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildMatchQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"empty", "", ""},
+		{"blank", "  \t ", ""},
+		{"one term", "hello", `"hello"`},
+		{"several terms", "  hello   world ", `"hello" "world"`},
+		{"fts5 operators", "cats OR dogs NOT fish*", `"cats" "OR" "dogs" "NOT" "fish*"`},
+		{"column filter", "content:secret", `"content:secret"`},
+		{"quotes", `say "hi"`, `"say" """hi"""`},
+		{"too many terms", strings.Repeat("a ", maxSearchTerms+5), strings.TrimSpace(strings.Repeat(`"a" `, maxSearchTerms))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildMatchQuery(tt.text); got != tt.want {
+				t.Errorf("buildMatchQuery(%q) = %s, want %s", tt.text, got, tt.want)
+			}
+		})
+	}
+}
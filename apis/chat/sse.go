@@ -0,0 +1,207 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	e "forum/apis/error"
+	u "forum/apis/user"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+var errStreamClosed = errors.New("event stream closed")
+
+// sseTransport writes frames as server-sent events, for browsers whose proxies break
+// websocket upgrades. The browser sends its frames to POST /chat/send instead.
+type sseTransport struct {
+	mu     sync.Mutex
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	remote string
+	ended  bool          // the stream is closed or the handler returned; w must not be touched
+	done   chan struct{} // closed when the stream should end
+}
+
+func (t *sseTransport) write(chunk string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended {
+		return errStreamClosed
+	}
+	t.rc.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := io.WriteString(t.w, chunk); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+func (t *sseTransport) writeFrame(data []byte) error {
+	return t.write("data: " + string(data) + "\n\n")
+}
+
+func (t *sseTransport) ping() error {
+	return t.write(": ping\n\n")
+}
+
+// close sends a "close" event carrying the same code and reason a websocket close would,
+// so the browser can tell whether to reconnect.
+func (t *sseTransport) close(code int, reason string) {
+	data, _ := json.Marshal(map[string]interface{}{"code": code, "reason": reason})
+	t.write("event: close\ndata: " + string(data) + "\n\n")
+	t.end()
+}
+
+func (t *sseTransport) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.ended {
+		t.ended = true
+		close(t.done)
+	}
+}
+
+func (t *sseTransport) remoteAddr() string {
+	return t.remote
+}
+
+func (t *sseTransport) name() string {
+	return "sse"
+}
+
+// ServeSSE serves GET /chat/events, the server-to-browser half of the SSE fallback. It checks
+// the Origin like /ws and /chat/send do, so a page that may not send cannot listen either. The
+// client registers with the hub exactly like a websocket one, so presence, replay and
+// fan-out are shared; its first event is a hello frame with the conn_id to post frames with.
+func ServeSSE(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hub.checkOrigin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	userID, loggedIn := u.ValidateSession(hub.DB, r)
+	if !loggedIn {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if hub.rejectIfBanned(w, userID) {
+		return
+	}
+
+	stream := &sseTransport{w: w, rc: http.NewResponseController(w), remote: r.RemoteAddr, done: make(chan struct{})}
+	client := &Client{
+		UserID:       userID,
+		Token:        cookie.Value,
+		Send:         make(chan Frontend, sendQueueSize),
+		LastSeen:     parseLastSeen(r.URL.Query().Get("last_seen")),
+		LastSeenRoom: parseLastSeen(r.URL.Query().Get("last_seen_room")),
+		hub:          hub,
+		transport:    stream,
+		connID:       uuid.New().String(),
+		connectedAt:  time.Now().UTC(),
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // keep nginx from holding events back
+	w.WriteHeader(http.StatusOK)
+
+	hub.Register <- client
+	// There is no read side to notice a dropped stream, so watch the request instead
+	go func() {
+		select {
+		case <-r.Context().Done():
+		case <-stream.done:
+		}
+		hub.Unregister <- client
+	}()
+
+	if err := client.write(Frontend{Type: TypeHello, To: userID, ConnID: client.connID, Timestamp: time.Now().UTC()}); err != nil {
+		client.closeWithReason(websocket.CloseGoingAway, "")
+	}
+	client.writePump(hub)
+	stream.end()
+}
+
+// SendHandler serves POST /chat/send?conn_id=, the browser-to-server half of the SSE
+// fallback. The body is one frame, handled exactly as if it had come over a websocket;
+// acks and errors arrive on the event stream. When another instance holds the stream, the
+// frame is forwarded there through the broker, so no sticky sessions are needed. Requiring a JSON content type keeps plain
+// cross-site forms from posting here.
+func SendHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hub.checkOrigin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		http.Error(w, "Invalid content type, expected application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	userID, loggedIn := u.ValidateSession(hub.DB, r)
+	if !loggedIn {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	connID := r.URL.Query().Get("conn_id")
+	client := hub.findConnection(userID, connID)
+	remote := false
+	if client == nil && connID != "" {
+		// The stream may be held by another instance behind the load balancer
+		var err error
+		if remote, err = hub.onOtherInstance(userID); err != nil {
+			fmt.Println("Error checking presence:", err)
+		}
+	}
+	if client == nil && !remote {
+		http.Error(w, "Unknown or closed connection", http.StatusNotFound)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Frames are limited to %d bytes", maxMessageSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if client != nil {
+		hub.receive(client, data)
+	} else if err := hub.Broker.Publish(Delivery{UserIDs: []int{userID}, ConnID: connID, Frame: data}); err != nil {
+		fmt.Println("Error forwarding frame:", err)
+		e.ErrorHandler(w, r, 500)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// findConnection returns the user's registered SSE client with the given conn_id, or nil.
+func (h *Hub) findConnection(userID int, connID string) *Client {
+	if connID == "" {
+		return nil
+	}
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	for client := range h.Clients[userID] {
+		if client.connID == connID {
+			return client
+		}
+	}
+	return nil
+}
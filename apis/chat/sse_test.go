@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSSEServer(t *testing.T, hub *Hub) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chat/events", func(w http.ResponseWriter, r *http.Request) { ServeSSE(hub, w, r) })
+	mux.HandleFunc("/chat/send", func(w http.ResponseWriter, r *http.Request) { SendHandler(hub, w, r) })
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// openStream opens an event stream as the user with the given session token and returns
+// the frames it carries.
+func openStream(t *testing.T, srv *httptest.Server, token string) <-chan Frontend {
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/chat/events", nil)
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET /chat/events: %s", res.Status)
+	}
+
+	frames := make(chan Frontend, 64)
+	go func() {
+		defer close(frames)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var msg Frontend
+			if json.Unmarshal([]byte(data), &msg) == nil {
+				frames <- msg
+			}
+		}
+	}()
+	return frames
+}
+
+// waitFor returns the first frame of the given type, skipping others.
+func waitFor(t *testing.T, frames <-chan Frontend, frameType string) Frontend {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-frames:
+			if !ok {
+				t.Fatalf("stream closed while waiting for %q", frameType)
+			}
+			if msg.Type == frameType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no %q frame", frameType)
+		}
+	}
+}
+
+func postFrame(t *testing.T, srv *httptest.Server, token, connID, frame string) int {
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/chat/send?conn_id="+connID, strings.NewReader(frame))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestSendHandler(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub(t, db, NewInMemoryBroker())
+	srv := newSSEServer(t, hub)
+
+	frames := openStream(t, srv, "tok1")
+	hello := waitFor(t, frames, TypeHello)
+
+	tests := []struct {
+		name   string
+		token  string
+		connID string
+		want   int
+	}{
+		{"own connection", "tok1", hello.ConnID, http.StatusAccepted},
+		{"unknown connection", "tok1", "nope", http.StatusNotFound},
+		{"someone else's connection", "tok2", hello.ConnID, http.StatusNotFound},
+		{"not logged in", "", hello.ConnID, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postFrame(t, srv, tt.token, tt.connID, `{"type":"typing","to":2}`); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// A frame posted to an instance that does not hold the stream is forwarded to the one that does.
+func TestSendHandlerOtherInstance(t *testing.T) {
+	db := newTestDB(t)
+	brokerA, err := NewSQLiteBroker(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	brokerB, err := NewSQLiteBroker(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvA := newSSEServer(t, newTestHub(t, db, brokerA))
+	srvB := newSSEServer(t, newTestHub(t, db, brokerB))
+
+	frames := openStream(t, srvA, "tok1")
+	hello := waitFor(t, frames, TypeHello)
+
+	frame := `{"type":"message","to":2,"content":"hello","client_id":"c1"}`
+	if got := postFrame(t, srvB, "tok1", hello.ConnID, frame); got != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", got, http.StatusAccepted)
+	}
+	if ack := waitFor(t, frames, TypeAck); ack.ClientID != "c1" || ack.ID == 0 {
+		t.Errorf("ack = %+v, want the saved message for client_id c1", ack)
+	}
+}
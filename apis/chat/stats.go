@@ -0,0 +1,146 @@
+package chat
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+const meterWindow = 60 // seconds covered by the rates in HubStats
+
+// rateMeter counts events in one-second buckets over the last meterWindow seconds.
+type rateMeter struct {
+	mu     sync.Mutex
+	total  uint64
+	counts [meterWindow]uint64
+	secs   [meterWindow]int64
+}
+
+func (m *rateMeter) mark(now time.Time) {
+	sec := now.Unix()
+	i := sec % meterWindow
+	m.mu.Lock()
+	if m.secs[i] != sec {
+		m.secs[i] = sec
+		m.counts[i] = 0
+	}
+	m.counts[i]++
+	m.total++
+	m.mu.Unlock()
+}
+
+type MeterStats struct {
+	Total      uint64  `json:"total"`       // since the hub started
+	LastMinute uint64  `json:"last_minute"` // in the last 60 seconds
+	PerSecond  float64 `json:"per_second"`  // average over the last 60 seconds
+}
+
+func (m *rateMeter) snapshot(now time.Time) MeterStats {
+	sec := now.Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var recent uint64
+	for i := range m.counts {
+		if age := sec - m.secs[i]; age >= 0 && age < meterWindow {
+			recent += m.counts[i]
+		}
+	}
+	return MeterStats{Total: m.total, LastMinute: recent, PerSecond: float64(recent) / meterWindow}
+}
+
+// hubMeters are the counters behind HubStats; they are updated without taking hub.Mutex.
+type hubMeters struct {
+	startedAt time.Time
+	framesIn  rateMeter // frames read from browsers
+	framesOut rateMeter // frames written to browsers
+	messages  rateMeter // direct and room messages saved
+	dropped   rateMeter // connections closed because their queue was full
+}
+
+type ClientStats struct {
+	UserID        int       `json:"user_id"`
+	Transport     string    `json:"transport"`
+	RemoteAddr    string    `json:"remote_addr"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	QueueDepth    int       `json:"queue_depth"`
+	QueueCapacity int       `json:"queue_capacity"`
+}
+
+type StoreStats struct {
+	Conversations int `json:"conversations"` // direct chats and rooms held in MessageStore
+	Messages      int `json:"messages"`
+	ContentBytes  int `json:"content_bytes"` // message text only, a lower bound on memory use
+}
+
+// HubStats is a snapshot of one hub instance. With a shared broker every instance
+// reports only the connections it holds itself.
+type HubStats struct {
+	StartedAt       time.Time     `json:"started_at"`
+	Uptime          string        `json:"uptime"`
+	Broker          string        `json:"broker"`
+	Users           int           `json:"users"`
+	Connections     int           `json:"connections"`
+	Clients         []ClientStats `json:"clients"` // deepest queues first
+	FramesIn        MeterStats    `json:"frames_in"`
+	FramesOut       MeterStats    `json:"frames_out"`
+	Messages        MeterStats    `json:"messages"`
+	SlowDisconnects MeterStats    `json:"slow_disconnects"`
+	Store           StoreStats    `json:"store"`
+	BannedUsers     int           `json:"banned_users"`
+	Goroutines      int           `json:"goroutines"`
+	Retention       string        `json:"retention,omitempty"`
+}
+
+// Stats reports what the hub holds right now.
+func (h *Hub) Stats() HubStats {
+	now := time.Now().UTC()
+	stats := HubStats{
+		StartedAt:       h.meters.startedAt,
+		Uptime:          now.Sub(h.meters.startedAt).Round(time.Second).String(),
+		Broker:          fmt.Sprintf("%T", h.Broker),
+		Clients:         []ClientStats{},
+		FramesIn:        h.meters.framesIn.snapshot(now),
+		FramesOut:       h.meters.framesOut.snapshot(now),
+		Messages:        h.meters.messages.snapshot(now),
+		SlowDisconnects: h.meters.dropped.snapshot(now),
+		BannedUsers:     h.limits.bannedCount(now),
+		Goroutines:      runtime.NumGoroutine(),
+	}
+	if h.Retention > 0 {
+		stats.Retention = h.Retention.String()
+	}
+
+	h.Mutex.RLock()
+	stats.Users = len(h.Clients)
+	for _, devices := range h.Clients {
+		for client := range devices {
+			stats.Clients = append(stats.Clients, ClientStats{
+				UserID:        client.UserID,
+				Transport:     client.transport.name(),
+				RemoteAddr:    client.transport.remoteAddr(),
+				ConnectedAt:   client.connectedAt,
+				QueueDepth:    len(client.Send),
+				QueueCapacity: cap(client.Send),
+			})
+		}
+	}
+	stats.Store.Conversations = len(h.MessageStore)
+	for _, messages := range h.MessageStore {
+		stats.Store.Messages += len(messages)
+		for _, m := range messages {
+			stats.Store.ContentBytes += len(m.Content)
+		}
+	}
+	h.Mutex.RUnlock()
+
+	stats.Connections = len(stats.Clients)
+	sort.Slice(stats.Clients, func(i, j int) bool {
+		if stats.Clients[i].QueueDepth != stats.Clients[j].QueueDepth {
+			return stats.Clients[i].QueueDepth > stats.Clients[j].QueueDepth
+		}
+		return stats.Clients[i].UserID < stats.Clients[j].UserID
+	})
+	return stats
+}
@@ -0,0 +1,45 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// transport carries frames from the hub to one browser connection. writePump is the only
+// caller of writeFrame and ping; close may be called from any goroutine.
+type transport interface {
+	writeFrame(data []byte) error // gives up after writeWait
+	ping() error
+	close(code int, reason string) // tells the browser why, if it can, then closes
+	remoteAddr() string
+	name() string
+}
+
+type wsTransport struct {
+	conn *websocket.Conn
+}
+
+func (t wsTransport) writeFrame(data []byte) error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (t wsTransport) ping() error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (t wsTransport) close(code int, reason string) {
+	deadline := time.Now().Add(time.Second)
+	t.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	t.conn.Close()
+}
+
+func (t wsTransport) remoteAddr() string {
+	return t.conn.RemoteAddr().String()
+}
+
+func (t wsTransport) name() string {
+	return "websocket"
+}
@@ -5,17 +5,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"forum/apis/chat"
 	u "forum/apis/user"
 	"log/slog"
 	"net/http"
 )
 
 type LikesController struct {
-	s LikesService
+	s      LikesService
+	events chat.Publisher
 }
 
-func NewLikesController(s LikesService) *LikesController {
-	return &LikesController{s: s}
+func NewLikesController(s LikesService, events chat.Publisher) *LikesController {
+	return &LikesController{s: s, events: events}
 }
 
 func (c *LikesController) LikeDislikePost(w http.ResponseWriter, r *http.Request, db *sql.DB) {
@@ -72,6 +74,14 @@ func (c *LikesController) LikeDislikePost(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	c.events.PublishForumEvent(chat.Frontend{
+		Type:   chat.TypeNewPostLike,
+		From:   userID,
+		PostId: *req.PostID,
+		IsLike: req.IsLike,
+		Counts: &chat.InteractionCounts{Likes: updatedCounts.Likes, Dislikes: updatedCounts.Dislikes},
+	})
+
 	//  Send JSON response with updated counts
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -151,6 +161,14 @@ func (c *LikesController) InteractWithComment(w http.ResponseWriter, r *http.Req
 
 	fmt.Printf(" Updated Counts -> Likes: %d, Dislikes: %d\n", updatedCounts.Likes, updatedCounts.Dislikes)
 
+	c.events.PublishForumEvent(chat.Frontend{
+		Type:      chat.TypeNewCommentLike,
+		From:      userID,
+		CommentId: *req.CommentID,
+		IsLike:    req.IsLike,
+		Counts:    &chat.InteractionCounts{Likes: updatedCounts.Likes, Dislikes: updatedCounts.Dislikes},
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":  "Interaction updated successfully",
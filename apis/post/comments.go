@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"forum/apis/chat"
 	u "forum/apis/user"
 	database "forum/database"
 	"io"
@@ -49,7 +50,7 @@ func GetComments(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(comments)
 }
 
-func CreateComment(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+func CreateComment(db *sql.DB, w http.ResponseWriter, r *http.Request, events chat.Publisher) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -109,17 +110,20 @@ func CreateComment(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Insert comment into the database
-	_, _, err = database.InsertComment(db, requestData.PostID, userID, requestData.Content)
+	commentID, _, err := database.InsertComment(db, requestData.PostID, userID, requestData.Content)
 	if err != nil {
 		fmt.Println(" Error inserting comment:", err)
 		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
 		return
 	}
 
+	events.PublishForumEvent(chat.Frontend{Type: chat.TypeNewComment, From: userID, PostId: requestData.PostID, CommentId: int(commentID)})
+
 	// Send success response
 	response := map[string]interface{}{
-		"success": true,
-		"message": "Comment added successfully.",
+		"success":    true,
+		"message":    "Comment added successfully.",
+		"comment_id": commentID,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
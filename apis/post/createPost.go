@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"forum/apis/chat"
 	u "forum/apis/user"
 	"forum/database"
 	"net/http"
@@ -16,8 +17,8 @@ type Post struct {
 	Categories []string `json:"categories"`
 }
 
-// CreatePost handles post submission
-func CreatePost(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+// CreatePost handles post submission and announces the new post to connected users
+func CreatePost(db *sql.DB, w http.ResponseWriter, r *http.Request, events chat.Publisher) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -87,6 +88,8 @@ func CreatePost(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	events.PublishForumEvent(chat.Frontend{Type: chat.TypeNewPost, From: userID, PostId: int(postID)})
+
 	// Send success response
 	response := map[string]interface{}{
 		"success":   true,
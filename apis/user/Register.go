@@ -241,6 +241,14 @@ func CheckIfPassValid(pass string) bool {
 	return hasUpper && hasLower && hasNumber && hasSpecial
 }
 
+// IsAdmin reports whether the user may use the admin endpoints. There is no UI for granting
+// it; an operator sets users.is_admin = 1 in the database.
+func IsAdmin(db *sql.DB, userID int) bool {
+	var isAdmin bool
+	err := db.QueryRow(`SELECT is_admin FROM users WHERE id = ?`, userID).Scan(&isAdmin)
+	return err == nil && isAdmin
+}
+
 func ValidateSession(db *sql.DB, r *http.Request) (int, bool) {
 	cookie, err := r.Cookie("session_token")
 	if err != nil {
@@ -9,7 +9,8 @@ import (
 )
 
 func ConnectToDatabase() *sql.DB {
-	db, err := sql.Open("sqlite", "./forum.db")
+	// Several forum processes may share the file, so wait on locks instead of failing
+	db, err := sql.Open("sqlite", "./forum.db?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -28,6 +29,28 @@ func CreateTables(db *sql.DB) error {
 		createLikes,
 		createSession,
         createMessage,
+		createChatRooms,
+		createChatRoomMembers,
+		createRoomMessages,
+		migrateMessageReceipts,
+		createMessageIndexes,
+		migrateMessageEdits,
+		migrateUserLastSeen,
+		createMessageSearch,
+		createAttachments,
+		createUserBlocks,
+		createConversationMutes,
+		createChatOutbox,
+		migrateMessageClientIDs,
+		createUserKeys,
+		migrateEncryptedMessages,
+		createConversationTimers,
+		migrateMessageExpiry,
+		migrateUserAdmin,
+		migrateMessageReplies,
+		createMessageReactions,
+		createChatPresence,
+		migrateRoomInvites,
 	}
 
 	for _, fn := range tableFunctions {
@@ -145,3 +168,363 @@ func createMessage(db *sql.DB) error {
     _, err := db.Exec(query)
 	return err
 }
+
+func createChatRooms(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS chat_rooms (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL,
+        created_by INTEGER NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (created_by) REFERENCES users(id)
+    );`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createChatRoomMembers(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS chat_room_members (
+        room_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (room_id, user_id),
+        FOREIGN KEY (room_id) REFERENCES chat_rooms(id),
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createRoomMessages(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS room_messages (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        room_id INTEGER NOT NULL,
+        sender_id INTEGER NOT NULL,
+        content TEXT NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (room_id) REFERENCES chat_rooms(id),
+        FOREIGN KEY (sender_id) REFERENCES users(id)
+    );`
+	_, err := db.Exec(query)
+	return err
+}
+
+// addColumn adds a column to a table created by an earlier version, skipping it when it already exists.
+func addColumn(db *sql.DB, table, column, definition string) error {
+	var count int
+	query := `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`
+	if err := db.QueryRow(query, table, column).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
+
+func migrateMessageReceipts(db *sql.DB) error {
+	if err := addColumn(db, "messages", "delivered_at", "DATETIME"); err != nil {
+		return err
+	}
+	return addColumn(db, "messages", "read_at", "DATETIME")
+}
+
+func createMessageIndexes(db *sql.DB) error {
+	queries := []string{
+		`CREATE INDEX IF NOT EXISTS idx_messages_pair_created ON messages (sender_id, receiver_id, created_at, id);`,
+		`CREATE INDEX IF NOT EXISTS idx_room_messages_room_created ON room_messages (room_id, created_at, id);`,
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateMessageEdits(db *sql.DB) error {
+	if err := addColumn(db, "messages", "edited_at", "DATETIME"); err != nil {
+		return err
+	}
+	return addColumn(db, "messages", "deleted_at", "DATETIME")
+}
+
+func migrateUserLastSeen(db *sql.DB) error {
+	return addColumn(db, "users", "last_seen_at", "DATETIME")
+}
+
+// createMessageSearch builds an FTS5 index over messages.content. Triggers keep it in
+// sync with inserts, edits and deletes; an index created over existing rows is backfilled.
+func createMessageSearch(db *sql.DB) error {
+	var exists int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'messages_fts'`).Scan(&exists); err != nil {
+		return err
+	}
+
+	queries := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+        content,
+        content='messages',
+        content_rowid='id',
+        tokenize='unicode61 remove_diacritics 2'
+    );`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+        INSERT INTO messages_fts (rowid, content) VALUES (new.id, new.content);
+    END;`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+        INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+    END;`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+        INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+        INSERT INTO messages_fts (rowid, content) VALUES (new.id, new.content);
+    END;`,
+	}
+	if exists == 0 {
+		queries = append(queries, `INSERT INTO messages_fts (messages_fts) VALUES ('rebuild');`)
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createAttachments(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS attachments (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        uploader_id INTEGER NOT NULL,
+        message_id INTEGER,
+        filename TEXT NOT NULL,
+        mime_type TEXT NOT NULL,
+        size INTEGER NOT NULL,
+        storage_name TEXT NOT NULL UNIQUE,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (uploader_id) REFERENCES users(id),
+        FOREIGN KEY (message_id) REFERENCES messages(id)
+    );`
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments (message_id);`)
+	return err
+}
+
+func createUserBlocks(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS user_blocks (
+        blocker_id INTEGER NOT NULL,
+        blocked_id INTEGER NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (blocker_id, blocked_id),
+        FOREIGN KEY (blocker_id) REFERENCES users(id),
+        FOREIGN KEY (blocked_id) REFERENCES users(id)
+    );`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createConversationMutes(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS conversation_mutes (
+        user_id INTEGER NOT NULL,
+        peer_id INTEGER NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (user_id, peer_id),
+        FOREIGN KEY (user_id) REFERENCES users(id),
+        FOREIGN KEY (peer_id) REFERENCES users(id)
+    );`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createChatOutbox(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS chat_outbox (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        instance_id TEXT NOT NULL,
+        payload TEXT NOT NULL,
+        created_at DATETIME NOT NULL
+    );`
+	_, err := db.Exec(query)
+	return err
+}
+
+// migrateMessageClientIDs records the browser-generated ID of each message so a resent
+// frame can be recognised instead of stored twice.
+func migrateMessageClientIDs(db *sql.DB) error {
+	if err := addColumn(db, "messages", "client_id", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumn(db, "room_messages", "client_id", "TEXT"); err != nil {
+		return err
+	}
+	queries := []string{
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_client_id ON messages (sender_id, client_id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_room_messages_client_id ON room_messages (sender_id, client_id)`,
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createUserKeys(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS user_keys (
+        key_id TEXT PRIMARY KEY,
+        user_id INTEGER NOT NULL,
+        algorithm TEXT NOT NULL,
+        public_key TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        revoked_at DATETIME,
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );`
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_user_keys_user ON user_keys (user_id)`)
+	return err
+}
+
+// migrateEncryptedMessages adds the end-to-end encryption envelope to messages and
+// replaces the search triggers with ones that never index ciphertext.
+func migrateEncryptedMessages(db *sql.DB) error {
+	columns := []struct{ name, definition string }{
+		{"encrypted", "INTEGER NOT NULL DEFAULT 0"},
+		{"sender_key_id", "TEXT"},
+		{"recipient_key_id", "TEXT"},
+		{"nonce", "TEXT"},
+	}
+	for _, c := range columns {
+		if err := addColumn(db, "messages", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+
+	queries := []string{
+		`DROP TRIGGER IF EXISTS messages_fts_insert;`,
+		`DROP TRIGGER IF EXISTS messages_fts_delete;`,
+		`DROP TRIGGER IF EXISTS messages_fts_update;`,
+		`CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages WHEN new.encrypted = 0 BEGIN
+        INSERT INTO messages_fts (rowid, content) VALUES (new.id, new.content);
+    END;`,
+		`CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages WHEN old.encrypted = 0 BEGIN
+        INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+    END;`,
+		`CREATE TRIGGER messages_fts_update AFTER UPDATE OF content, encrypted ON messages BEGIN
+        INSERT INTO messages_fts (messages_fts, rowid, content) SELECT 'delete', old.id, old.content WHERE old.encrypted = 0;
+        INSERT INTO messages_fts (rowid, content) SELECT new.id, new.content WHERE new.encrypted = 0;
+    END;`,
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createConversationTimers stores disappearing-message timers, one row per pair with user_a < user_b.
+func createConversationTimers(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS conversation_timers (
+        user_a INTEGER NOT NULL,
+        user_b INTEGER NOT NULL,
+        seconds INTEGER NOT NULL,
+        set_by INTEGER NOT NULL,
+        updated_at DATETIME NOT NULL,
+        PRIMARY KEY (user_a, user_b),
+        FOREIGN KEY (user_a) REFERENCES users(id),
+        FOREIGN KEY (user_b) REFERENCES users(id)
+    );`
+	_, err := db.Exec(query)
+	return err
+}
+
+func migrateMessageExpiry(db *sql.DB) error {
+	if err := addColumn(db, "messages", "expires_at", "DATETIME"); err != nil {
+		return err
+	}
+	queries := []string{
+		`CREATE INDEX IF NOT EXISTS idx_messages_expires ON messages (expires_at) WHERE expires_at IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_created ON messages (created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_room_messages_created ON room_messages (created_at)`,
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateUserAdmin marks users allowed to use the admin endpoints; nobody is an admin by default.
+func migrateUserAdmin(db *sql.DB) error {
+	return addColumn(db, "users", "is_admin", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// migrateMessageReplies links a direct message to the one it answers. There is no foreign
+// key: parents can be purged, and their replies then show a tombstone.
+func migrateMessageReplies(db *sql.DB) error {
+	if err := addColumn(db, "messages", "reply_to_id", "INTEGER"); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_reply_to ON messages (reply_to_id) WHERE reply_to_id IS NOT NULL`)
+	return err
+}
+
+// createMessageReactions stores emoji reactions on direct messages, one row per user and emoji.
+func createMessageReactions(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS message_reactions (
+        message_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        emoji TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        PRIMARY KEY (message_id, user_id, emoji),
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );`
+	_, err := db.Exec(query)
+	return err
+}
+
+// createChatPresence tracks how many connections each hub instance holds per user, so
+// every instance can tell whether a user is online anywhere. Instances heartbeat into
+// chat_instances; rows of an instance that stopped are ignored and then removed.
+func createChatPresence(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS chat_instances (
+        instance_id TEXT PRIMARY KEY,
+        heartbeat_at DATETIME NOT NULL
+    );`
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+	query = `CREATE TABLE IF NOT EXISTS chat_presence (
+        instance_id TEXT NOT NULL,
+        user_id INTEGER NOT NULL,
+        connections INTEGER NOT NULL,
+        PRIMARY KEY (instance_id, user_id)
+    );`
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_chat_presence_user ON chat_presence (user_id)`)
+	return err
+}
+
+// migrateRoomInvites makes room membership invitation-only. visible_after_id hides the
+// messages sent before a member joined; existing members keep seeing everything.
+func migrateRoomInvites(db *sql.DB) error {
+	if err := addColumn(db, "chat_room_members", "visible_after_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	query := `CREATE TABLE IF NOT EXISTS chat_room_invites (
+        room_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        invited_by INTEGER NOT NULL,
+        created_at DATETIME NOT NULL,
+        PRIMARY KEY (room_id, user_id),
+        FOREIGN KEY (room_id) REFERENCES chat_rooms(id),
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );`
+	_, err := db.Exec(query)
+	return err
+}
@@ -52,3 +52,12 @@ func DeleteSession(db *sql.DB, sessionID int) error {
 	}
 	return err
 }
+
+func DeleteSessionByToken(db *sql.DB, token string) error {
+	query := `DELETE FROM sessions WHERE token = ?`
+	_, err := db.Exec(query, token)
+	if err != nil {
+		fmt.Println(" Error deleting session:", err)
+	}
+	return err
+}
@@ -3,8 +3,20 @@ let socket = null;
 let loggedInUserId = null;
 let selectedUserId = null;
 let typingTimeout = null;
-let currentOffset = 0;
+let nextCursor = null; // Opaque cursor for the next (older) page of history
+let historyExhausted = false;
 let throttle = false;
+let lastSeenId = 0; // Newest direct message ID received, sent back on reconnect
+let lastSeenRoomId = 0; // Newest room message ID received
+let reconnectDelay = 1000;
+let closingOnPurpose = false;
+let useSSE = false; // set once a websocket fails to open; see transport.js
+let connectedOnce = false; // later opens are reconnects, after which the sidebar is refetched
+const PROTOCOL_VERSION = 1;
+const pendingMessages = new Map(); // client_id -> frame sent but not yet acknowledged
+const pendingChanges = new Set(); // client_ids of edits and deletes awaiting an ack
+let replyingTo = null; // { id, peer, from, content } of the message the next one answers
+const QUICK_REACTIONS = ["👍", "❤️", "😂", "😮", "😢", "🙏"];
 
 let Myusername;
 let Theirname;
@@ -22,19 +34,59 @@ function connectWebSocket(userId) {
     return; // Exit if in error state
   }
 
-  socket = new WebSocket(`ws://localhost:8888/ws?user_id=${userId}`);
+  // The server identifies us from the session cookie sent with the request
+  const params = new URLSearchParams();
+  if (lastSeenId > 0) params.set("last_seen", lastSeenId);
+  if (lastSeenRoomId > 0) params.set("last_seen_room", lastSeenRoomId);
 
-  socket.onerror = () => {
-    console.log("WebSocket error occurred");
+  const onOpen = () => {
+    console.log(useSSE ? "Event stream connected" : "WebSocket connected");
+    reconnectDelay = 1000;
+    // Updates pushed while we were away are lost; rebuild the sidebar once
+    if (connectedOnce) fetchUserList();
+    connectedOnce = true;
+    // Resend anything the server never acknowledged; it drops copies it already saved
+    for (const frame of pendingMessages.values()) {
+      sendFrame(frame);
+    }
   };
 
-  socket.onopen = () => {
-    console.log("WebSocket connected");
+  const onClose = ({ code, opened }) => {
+    console.log("Chat connection closed");
+    // 1008 means the server ended our session; reconnecting would be refused
+    if (closingOnPurpose || isErrorState || code === 1008) return;
+    // A websocket that never opens is usually a proxy refusing the upgrade
+    if (!opened && !useSSE) {
+      console.log("WebSocket unavailable; falling back to server-sent events");
+      useSSE = true;
+      connectWebSocket(userId);
+      return;
+    }
+    // Reconnect with backoff; the server replays whatever arrived meanwhile
+    setTimeout(() => connectWebSocket(userId), reconnectDelay);
+    reconnectDelay = Math.min(reconnectDelay * 2, 30000);
   };
 
-  socket.onmessage = (event) => {
-    const msg = JSON.parse(event.data);
+  const onFrame = (msg) => {
     console.log(msg.type);
+    if (msg.type === "message" && msg.id > lastSeenId) {
+      lastSeenId = msg.id;
+    }
+    if (msg.type === "room_message" && msg.id > lastSeenRoomId) {
+      lastSeenRoomId = msg.id;
+    }
+    if (msg.type === "ack") {
+      handleAck(msg);
+      return;
+    }
+
+    if (msg.type === "error") {
+      handleErrorFrame(msg);
+      return;
+    }
+
+    if (handleRoomFrame(msg)) return;
+
     if (msg.type === "typing") {
       if (msg.from === selectedUserId) {
         showTypingIndicator(Theirname);
@@ -43,8 +95,65 @@ function connectWebSocket(userId) {
     }
 
     if (msg.type === "message") {
-      appendMessageToChat(msg);
-      updateUserPreview(msg);
+      const peerId = msg.from === loggedInUserId ? msg.to : msg.from;
+      if (peerId === selectedUserId) appendMessageToChat(msg); // Others only get a badge
+      if (!msg.silent) {
+        updateUserPreview(msg); // Muted conversations get no badge
+      }
+      if (msg.from === selectedUserId) {
+        sendReadReceipt(msg.from, msg.id);
+      }
+      return;
+    }
+
+    if (msg.type === "announcement") {
+      showAnnouncement(msg.content);
+      return;
+    }
+
+    if (msg.type === "system") {
+      appendSystemMessage(msg.content);
+      return;
+    }
+
+    if (msg.type === "messages_expired") {
+      removeExpiredMessages(msg.ids || []);
+      return;
+    }
+
+    if (msg.type === "message_edited") {
+      const node = document.querySelector(`.chat-message[data-id="${msg.id}"]`);
+      if (node) showEdited(node, msg);
+      updateQuotes(msg);
+      return;
+    }
+
+    if (msg.type === "message_deleted") {
+      markQuotesDeleted(msg.id);
+      const node = document.querySelector(`.chat-message[data-id="${msg.id}"]`);
+      if (node) showDeleted(node);
+      return;
+    }
+
+    if (msg.type === "reaction") {
+      const node = document.querySelector(`.chat-message[data-id="${msg.id}"]`);
+      if (node) renderReactions(node, msg.reactions || []);
+      return;
+    }
+
+    if (msg.type === "timer_changed") {
+      const peerId = msg.from === loggedInUserId ? msg.to : msg.from;
+      if (peerId === selectedUserId) showTimer(msg.ttl || 0);
+      return;
+    }
+
+    if (msg.type === "conversation_update") {
+      applyConversationUpdate(msg.conversation);
+      return;
+    }
+
+    if (msg.type === "conversation_removed") {
+      removeConversation(msg.from);
       return;
     }
 
@@ -52,6 +161,11 @@ function connectWebSocket(userId) {
       updateUserStatus(msg.username, msg.status);
     }
 
+    if (msg.type === "user_online" || msg.type === "user_offline") {
+      updatePresence(msg.from, msg.type === "user_online", msg.timestamp);
+      return;
+    }
+
     if (msg.type === "new_user") {
       fetchUserList(); // Fetch updated user list when a new user is created
       return;
@@ -85,11 +199,10 @@ function connectWebSocket(userId) {
     
     return;
   }
+  };
 
-    socket.onclose = () => {
-      console.log("WebSocket disconnected");
-    };
-  }
+  const handlers = { onOpen, onClose, onFrame };
+  socket = useSSE ? openSSETransport(params, handlers) : openWebSocketTransport(params, handlers);
 }
 function updateUserStatus(username, status) {
   const userList = document
@@ -111,19 +224,179 @@ function updateUserStatus(username, status) {
   }
 }
 
-function sendMessage(toId, content) {
-  if (!socket || socket.readyState !== WebSocket.OPEN) return;
+// Moves the conversation's entry to the top of the sidebar and refreshes its badge and dot.
+function applyConversationUpdate(conversation) {
+  if (!conversation) return;
+  const li = document.querySelector(`#userList li[data-user-id="${conversation.user_id}"]`);
+  if (!li) {
+    fetchUserList(); // Someone we have not listed yet
+    return;
+  }
+  li.classList.toggle("has-new-message", conversation.unread > 0);
+  const statusDot = li.querySelector(".status-dot");
+  statusDot.classList.toggle("online", conversation.online);
+  statusDot.classList.toggle("offline", !conversation.online);
+  if (conversation.online) statusDot.title = "Online";
+  li.parentElement.prepend(li);
+}
+
+// The conversation has no messages left, or one of us blocked the other
+function removeConversation(peerId) {
+  const li = document.querySelector(`#userList li[data-user-id="${peerId}"]`);
+  if (li) li.classList.remove("has-new-message");
+  fetchUserList(); // Reorders the list and drops users hidden by a block
+}
+
+function updatePresence(userId, online, lastSeen) {
+  const li = document.querySelector(`#userList li[data-user-id="${userId}"]`);
+  if (!li) {
+    if (online && userId !== loggedInUserId) fetchUserList(); // Someone we have not listed yet
+    return;
+  }
+
+  const statusDot = li.querySelector(".status-dot");
+  statusDot.classList.toggle("online", online);
+  statusDot.classList.toggle("offline", !online);
+  statusDot.title = online ? "Online" : formatLastSeen(lastSeen);
+}
+
+function formatLastSeen(lastSeen) {
+  if (!lastSeen) return "Offline";
+  const minutes = Math.floor((Date.now() - new Date(lastSeen).getTime()) / 60000);
+  if (minutes < 1) return "Last seen just now";
+  if (minutes < 60) return `Last seen ${minutes} min ago`;
+  if (minutes < 24 * 60) return `Last seen ${Math.floor(minutes / 60)} h ago`;
+  return `Last seen ${new Date(lastSeen).toLocaleDateString()}`;
+}
+
+// sendFrame wraps a frame in the versioned envelope; it reports whether the socket took it.
+function sendFrame(frame) {
+  if (!socket || !socket.open) return false;
+  return socket.send({ v: PROTOCOL_VERSION, ...frame });
+}
+
+function newClientId() {
+  if (window.crypto && crypto.randomUUID) return crypto.randomUUID();
+  return `${Date.now()}-${Math.random().toString(36).slice(2)}`;
+}
+
+// Same rule as the server's command names; other lines starting with "/" are plain text.
+const SLASH_COMMAND = /^\/[a-z][a-z0-9_-]{0,31}(\s|$)/i;
+// Commands that only answer the user who typed them. Any other command could post its
+// text into the conversation, so it is refused where messages are end-to-end encrypted.
+const PRIVATE_COMMANDS = new Set(["help", "remind"]);
 
+// attachment is the metadata /attachments returned for a file uploaded with this message.
+async function sendMessage(toId, content, attachment = null) {
   const message = {
     type: "message",
-    from: loggedInUserId,
+    client_id: newClientId(),
     to: toId,
     content: content,
-    timestamp: new Date().toISOString(),
   };
+  if (replyingTo && replyingTo.peer === toId) {
+    message.reply_to = replyingTo.id;
+  }
+  const quoted = replyingTo;
+  clearReply();
+
+  if (attachment) {
+    // The server stores files in the clear, so they only go to plaintext conversations
+    message.attachment_id = attachment.id;
+    pendingMessages.set(message.client_id, message);
+    sendFrame(message);
+    appendMessageToChat({
+      ...message,
+      attachment,
+      reply_preview: message.reply_to ? { id: quoted.id, from: quoted.from, content: quoted.content } : undefined,
+      from: loggedInUserId,
+      timestamp: new Date().toISOString(),
+    });
+    return;
+  }
+
+  // Slash commands run on the server, which echoes back whatever they post. The server
+  // has to read them, so they are never sealed.
+  if (SLASH_COMMAND.test(content)) {
+    const name = content.slice(1).split(/\s/, 1)[0].toLowerCase();
+    if (!PRIVATE_COMMANDS.has(name) && (await encryptionKeyFor(toId).catch(() => true))) {
+      appendSystemMessage(`/${name} is not available in end-to-end encrypted conversations. Start with // to send a message beginning with /.`);
+      return;
+    }
+    pendingMessages.set(message.client_id, message);
+    sendFrame(message);
+    return;
+  }
+  // "//" sends a literal leading slash; the server strips it from plain messages but
+  // cannot see inside encrypted ones
+  const shown = content.startsWith("//") ? content.slice(1) : content;
+
+  try {
+    const sealed = await sealForPeer(toId, shown);
+    if (sealed) Object.assign(message, sealed);
+  } catch (err) {
+    console.error("Encryption failed; message not sent:", err);
+    return;
+  }
+
+  // Kept until the server acknowledges it, and resent after a reconnect
+  pendingMessages.set(message.client_id, message);
+  sendFrame(message);
+  appendMessageToChat({
+    ...message,
+    content: shown, // Show what we typed, not the ciphertext
+    encrypted: false,
+    locked: message.encrypted,
+    reply_preview: message.reply_to ? { id: quoted.id, from: quoted.from, content: quoted.content } : undefined,
+    from: loggedInUserId,
+    timestamp: new Date().toISOString(),
+  });
+}
+
+function handleAck(ack) {
+  pendingChanges.delete(ack.client_id);
+  if (!pendingMessages.delete(ack.client_id)) return;
+  // Our own message; no need to have it replayed
+  if (ack.room_id) {
+    if (ack.id > lastSeenRoomId) lastSeenRoomId = ack.id;
+  } else if (ack.id > lastSeenId) {
+    lastSeenId = ack.id;
+  }
+  const node = document.querySelector(
+    `.chat-message[data-client-id="${CSS.escape(ack.client_id)}"]`
+  );
+  if (node) {
+    node.classList.remove("pending");
+    node.dataset.id = ack.id;
+  }
+}
+
+function handleErrorFrame(frame) {
+  const error = frame.error || {};
+  console.warn(`Server rejected a frame (${error.code}): ${error.message}`);
+  if (!frame.client_id) {
+    // Not about one frame, e.g. the rate limiter's notice before it disconnects us
+    if (error.code === "rate_limited") appendSystemMessage(error.message);
+    return;
+  }
+  if (pendingChanges.delete(frame.client_id)) {
+    appendSystemMessage(error.message || "The message could not be changed.");
+    return;
+  }
+  if (!pendingMessages.delete(frame.client_id)) return;
 
-  socket.send(JSON.stringify(message));
-  appendMessageToChat(message);
+  const node = document.querySelector(
+    `.chat-message[data-client-id="${CSS.escape(frame.client_id)}"]`
+  );
+  if (node) {
+    node.classList.remove("pending");
+    node.classList.add("failed");
+    node.title = error.message || "Message not sent";
+  }
+}
+
+function sendReadReceipt(withId, upToId = 0) {
+  sendFrame({ type: "read", to: withId, id: upToId });
 }
 
 function sendTypingSignal() {
@@ -131,12 +404,33 @@ function sendTypingSignal() {
 
   const signal = {
     type: "typing",
-    from: loggedInUserId,
-    username: Myusername, // Ensure this has the correct username
     to: selectedUserId,
   };
 
-  socket.send(JSON.stringify(signal));
+  sendFrame(signal);
+}
+
+// Shows a notice from an administrator at the top of the page until it is dismissed.
+function showAnnouncement(text) {
+  const banner = document.createElement("div");
+  banner.classList.add("announcement");
+  banner.textContent = `📢 ${text}`;
+  const close = document.createElement("button");
+  close.type = "button";
+  close.textContent = "×";
+  close.onclick = () => banner.remove();
+  banner.appendChild(close);
+  document.body.prepend(banner);
+}
+
+// Shows a private notice, such as a slash command's reply, in the open chat.
+function appendSystemMessage(text) {
+  const container = document.getElementById("chatWindow");
+  const node = document.createElement("div");
+  node.classList.add("chat-message", "system-message");
+  node.textContent = text;
+  container.append(node);
+  container.scrollTop = container.scrollHeight;
 }
 
 function showTypingIndicator(username) {
@@ -161,22 +455,30 @@ function showTypingIndicator(username) {
   }, 1000); // Hide after 1 second of inactivity
 }
 
-function loadMessages(withId, offset = 0) {
+function loadMessages(withId, before = null) {
   if (isErrorState) {
     console.warn(
       "loadMessages! Cannot send data; application is in an error state."
     );
     return; // Exit if in error state
   }
-  fetch(`/messages?with=${withId}&offset=${offset}`, { credentials: "include" })
+  const params = new URLSearchParams({ with: withId });
+  if (before) params.set("before", before);
+
+  return fetch(`/messages?${params}`, { credentials: "include" })
     .then((res) => res.json())
-    .then((messages) => {
-      if (!messages || !Array.isArray(messages)) {
+    .then((page) => {
+      if (!page || !Array.isArray(page.messages)) {
         console.warn("⚠️ No messages received or invalid format.");
         return;
       }
 
-      messages.forEach((msg) => prependMessageToChat(msg));
+      page.messages.forEach((msg) => {
+        prependMessageToChat(msg);
+        if (msg.id > lastSeenId) lastSeenId = msg.id;
+      });
+      nextCursor = page.next_cursor;
+      historyExhausted = !nextCursor;
       throttle = false;
     })
     .catch((err) => errorPage(500));
@@ -186,18 +488,29 @@ function appendMessageToChat(msg) {
   const messagesContainer = document.getElementById("chatWindow");
   const newMessage = document.createElement("div");
   newMessage.classList.add("chat-message");
+  if (msg.client_id) newMessage.dataset.clientId = msg.client_id;
+  if (msg.id) newMessage.dataset.id = msg.id;
+  if (msg.client_id && pendingMessages.has(msg.client_id)) {
+    newMessage.classList.add("pending"); // Waiting for the server's ack
+  }
 
   if (msg.from === loggedInUserId) {
     newMessage.classList.add("my-message"); // User's message
     newMessage.innerHTML = `<strong>${Myusername}</strong> <strong>${new Date(
       msg.timestamp
-    ).toLocaleString()}:</strong><br> ${msg.content}`;
+    ).toLocaleString()}:</strong><br> <span class="message-body">${msg.content}</span>`;
   } else {
     newMessage.classList.add("received-message"); // Received message
     newMessage.innerHTML = `<strong>${Theirname}</strong> <strong>${new Date(
       msg.timestamp
-    ).toLocaleString()}:</strong><br> ${msg.content}`;
+    ).toLocaleString()}:</strong><br> <span class="message-body">${msg.content}</span>`;
   }
+  if (msg.encrypted) {
+    showDecrypted(newMessage, msg);
+  } else if (msg.locked) {
+    newMessage.querySelector(".message-body").prepend("🔒 ");
+  }
+  decorateMessage(newMessage, msg);
 
   // Append the new message instead of prepending
   messagesContainer.append(newMessage); // Use append() instead of prepend()
@@ -208,19 +521,24 @@ function prependMessageToChat(msg) {
   const container = document.getElementById("chatWindow");
   const node = document.createElement("div");
   node.classList.add("chat-message");
+  if (msg.id) node.dataset.id = msg.id;
 
   // Determine the alignment based on the sender
   if (msg.from === loggedInUserId) {
     node.classList.add("my-message"); // User's message
     node.innerHTML = `<strong>${Myusername}</strong> <strong>${new Date(
       msg.timestamp
-    ).toLocaleString()}:</strong><br> ${msg.content}`;
+    ).toLocaleString()}:</strong><br> <span class="message-body">${msg.content}</span>`;
   } else {
     node.classList.add("received-message"); // Received message
     node.innerHTML = `<strong>${Theirname}</strong> <strong>${new Date(
       msg.timestamp
-    ).toLocaleString()}:</strong><br> ${msg.content}`;
+    ).toLocaleString()}:</strong><br> <span class="message-body">${msg.content}</span>`;
+  }
+  if (msg.encrypted) {
+    showDecrypted(node, msg);
   }
+  decorateMessage(node, msg);
 
   // Insert the new message at the top
   container.insertBefore(node, container.firstChild);
@@ -229,14 +547,14 @@ function prependMessageToChat(msg) {
 function setupScroll(chatUserId) {
   const container = document.getElementsByClassName("chat-window")[0];
   container.addEventListener("scroll", () => {
-    if (container.scrollTop === 0 && !throttle) {
+    if (chatUserId !== selectedUserId) return; // Set up for a chat opened earlier
+    if (container.scrollTop === 0 && !throttle && !historyExhausted) {
       throttle = true;
       if (currentHeight < maxHeight) {
         currentHeight += 10; // Increase height by 10
         container.style.height = `${currentHeight}px`; // Apply new height
       }
-      currentOffset += 10;
-      loadMessages(chatUserId, currentOffset);
+      loadMessages(chatUserId, nextCursor);
       // Reset throttle after loading messages
       setTimeout(() => {
         throttle = false; // Allow scrolling again after a short delay
@@ -290,7 +608,12 @@ function loadAndInitChat(userId) {
   connectWebSocket(userId);
   fetchUserList();
   setupChatForm();
-  updateUserListPeriodically();
+  setupEncryptionToggle();
+  setupTimerSelect();
+  setupSearch();
+  setupBlockAndMute();
+  setupRooms();
+  document.querySelector("#replyBar button").onclick = clearReply;
   chatWindow.scrollTop = chatWindow.scrollHeight;
 }
 
@@ -316,6 +639,11 @@ function fetchUserList() {
       }
       return res.json();
     })
+    .then((users) =>
+      fetch("/conversations", { credentials: "include" })
+        .then((res) => (res.ok ? res.json() : []))
+        .then((conversations) => sortByLastActivity(users, conversations))
+    )
     .then((users) => {
       const userList = document.getElementById("userList");
       userList.innerHTML = "";
@@ -329,6 +657,9 @@ function fetchUserList() {
             const li = document.createElement("li");
             li.dataset.userId = user.id;
             li.classList.add("user-item");
+            if (user.unread > 0) {
+              li.classList.add("has-new-message");
+            }
 
             // Create username span
             const usernameSpan = document.createElement("span");
@@ -338,6 +669,7 @@ function fetchUserList() {
             const statusDot = document.createElement("span");
             statusDot.classList.add("status-dot");
             statusDot.classList.add(user.online ? "online" : "offline");
+            statusDot.title = user.online ? "Online" : formatLastSeen(user.last_seen);
 
             // Append elements
             li.appendChild(usernameSpan);
@@ -354,10 +686,38 @@ function fetchUserList() {
     .catch((err) => errorPage(500));
 }
 
+// Puts users we have talked to first, most recent conversation on top,
+// and keeps everyone else in the order the server sent them.
+function sortByLastActivity(users, conversations) {
+  if (!Array.isArray(users)) return users;
+
+  const byPeer = new Map();
+  (conversations || []).forEach((c, index) => byPeer.set(c.user_id, { ...c, index }));
+
+  users.forEach((user) => {
+    const conversation = byPeer.get(user.id);
+    user.unread = conversation ? conversation.unread : 0;
+  });
+
+  return users
+    .map((user, index) => ({ user, index }))
+    .sort((a, b) => {
+      const ca = byPeer.get(a.user.id);
+      const cb = byPeer.get(b.user.id);
+      if (ca && cb) return ca.index - cb.index;
+      if (ca) return -1;
+      if (cb) return 1;
+      return a.index - b.index;
+    })
+    .map((entry) => entry.user);
+}
+
 function openChatWith(userId, username) {
+  leaveRoomView();
   Theirname = username;
   selectedUserId = userId;
-  currentOffset = 0;
+  nextCursor = null;
+  historyExhausted = false;
   chatWindow.style.display = "flex";
   document.getElementById("chatWindow").innerHTML = "";
   document.getElementById(
@@ -368,40 +728,513 @@ function openChatWith(userId, username) {
   const chatForm = document.getElementById("chatForm");
   chatForm.style.display = "flex";
 
-  loadMessages(userId);
+  const loaded = loadMessages(userId);
   setupScroll(userId);
+  sendReadReceipt(userId);
+  loadTimer(userId);
+  loadMuted(userId);
+  clearReply();
+  return loaded;
+}
+
+// Drops messages the server has purged, either because their timer ran out or retention did.
+function removeExpiredMessages(ids) {
+  const container = document.getElementById("chatWindow");
+  ids.forEach((id) => {
+    const node = container.querySelector(`.chat-message[data-id="${id}"]`);
+    if (node) node.remove();
+    markQuotesDeleted(id);
+  });
+}
+
+// Adds the quote of the message this one answers, and a button to answer it in turn.
+function decorateMessage(node, msg) {
+  if (msg.reply_preview) {
+    const quote = document.createElement("div");
+    quote.classList.add("reply-quote");
+    quote.dataset.replyTo = msg.reply_preview.id;
+    quote.textContent = quoteText(msg.reply_preview);
+    node.querySelector(".message-body").before(quote);
+  }
+  if (msg.deleted_at) {
+    showDeleted(node);
+    return;
+  }
+  if (msg.attachment) renderAttachment(node, msg.attachment);
+  if (msg.edited_at) markEdited(node);
+  const button = document.createElement("button");
+  button.type = "button";
+  button.classList.add("message-action");
+  button.title = "Reply";
+  button.textContent = "↩";
+  button.onclick = () => startReply(node, msg);
+  node.appendChild(button);
+
+  const pick = document.createElement("button");
+  pick.type = "button";
+  pick.classList.add("message-action");
+  pick.title = "React";
+  pick.textContent = "☺";
+  pick.onclick = () => toggleReactionPicker(node);
+  node.appendChild(pick);
+
+  if (msg.from === loggedInUserId) {
+    const edit = document.createElement("button");
+    edit.type = "button";
+    edit.classList.add("message-action");
+    edit.title = "Edit";
+    edit.textContent = "✎";
+    edit.onclick = () => editMessage(node, msg);
+    node.appendChild(edit);
+
+    const remove = document.createElement("button");
+    remove.type = "button";
+    remove.classList.add("message-action");
+    remove.title = "Delete";
+    remove.textContent = "🗑";
+    remove.onclick = () => deleteMessage(node);
+    node.appendChild(remove);
+  }
+  renderReactions(node, msg.reactions || []);
+}
+
+// Asks for the new text of one of our messages. An encrypted message stays encrypted with
+// the same keys, which the server checks; after a key rotation it can only be deleted.
+async function editMessage(node, msg) {
+  const id = Number(node.dataset.id); // set once the server has acknowledged our own messages
+  if (!id) return;
+  const current = node.querySelector(".message-body").textContent.replace(/^🔒 /, "");
+  const text = prompt("Edit message", current);
+  if (text === null || !text.trim() || text === current) return;
+
+  const frame = { type: "edit", id, content: text, client_id: newClientId() };
+  if (msg.encrypted || msg.locked) {
+    let sealed = null;
+    try {
+      sealed = await sealForPeer(selectedUserId, text);
+    } catch (err) {
+      console.error("Encryption failed; edit not sent:", err);
+    }
+    const sameKeys = sealed && (!msg.sender_key_id || sealed.sender_key_id === msg.sender_key_id);
+    if (!sameKeys) {
+      appendSystemMessage("This encrypted message can no longer be edited because the keys have changed.");
+      return;
+    }
+    Object.assign(frame, sealed);
+  }
+  pendingChanges.add(frame.client_id);
+  sendFrame(frame);
+}
+
+function deleteMessage(node) {
+  const id = Number(node.dataset.id);
+  if (!id || !confirm("Delete this message for everyone?")) return;
+  const frame = { type: "delete", id, client_id: newClientId() };
+  pendingChanges.add(frame.client_id);
+  sendFrame(frame);
+}
+
+// Shows one chip per emoji; ours are highlighted and clicking a chip toggles our reaction.
+function renderReactions(node, reactions) {
+  let row = node.querySelector(".reactions");
+  if (!row) {
+    row = document.createElement("div");
+    row.classList.add("reactions");
+    node.appendChild(row);
+  }
+  row.replaceChildren();
+  reactions.forEach((reaction) => {
+    const mine = reaction.user_ids.includes(loggedInUserId);
+    const chip = document.createElement("button");
+    chip.type = "button";
+    chip.classList.add("reaction-chip");
+    if (mine) chip.classList.add("mine");
+    chip.textContent = `${reaction.emoji} ${reaction.count}`;
+    chip.onclick = () => sendReaction(node, reaction.emoji, !mine);
+    row.appendChild(chip);
+  });
+}
+
+function toggleReactionPicker(node) {
+  const open = node.querySelector(".reaction-picker");
+  if (open) {
+    open.remove();
+    return;
+  }
+  const picker = document.createElement("div");
+  picker.classList.add("reaction-picker");
+  QUICK_REACTIONS.forEach((emoji) => {
+    const option = document.createElement("button");
+    option.type = "button";
+    option.textContent = emoji;
+    option.onclick = () => {
+      sendReaction(node, emoji, true);
+      picker.remove();
+    };
+    picker.appendChild(option);
+  });
+  node.appendChild(picker);
+}
+
+function sendReaction(node, emoji, add) {
+  const id = Number(node.dataset.id); // set once the server has acknowledged our own messages
+  if (!id) return;
+  sendFrame({ type: add ? "react" : "unreact", id, emoji });
+}
+
+function quoteText(preview) {
+  if (preview.deleted) return "Original message deleted";
+  const name = preview.from === loggedInUserId ? Myusername : Theirname;
+  return preview.encrypted ? `${name}: 🔒 Encrypted message` : `${name}: ${preview.content}`;
+}
+
+function markQuotesDeleted(id) {
+  document.querySelectorAll(`.reply-quote[data-reply-to="${id}"]`).forEach((quote) => {
+    quote.textContent = quoteText({ deleted: true });
+  });
+}
+
+function updateQuotes(msg) {
+  const preview = { from: msg.from, content: msg.content, encrypted: msg.encrypted };
+  document.querySelectorAll(`.reply-quote[data-reply-to="${msg.id}"]`).forEach((quote) => {
+    quote.textContent = quoteText(preview);
+  });
+}
+
+// Replaces the text of a message that its sender edited.
+function showEdited(node, msg) {
+  if (msg.encrypted) {
+    showDecrypted(node, msg);
+  } else {
+    node.querySelector(".message-body").textContent = msg.content;
+  }
+  markEdited(node);
+}
+
+function markEdited(node) {
+  if (node.querySelector(".edited-label")) return;
+  const label = document.createElement("span");
+  label.classList.add("edited-label");
+  label.textContent = " (edited)";
+  node.querySelector(".message-body").after(label);
+}
+
+// Turns a message into a placeholder, live when it is deleted or when history has a tombstone.
+function showDeleted(node) {
+  node.classList.add("deleted-message");
+  node.querySelector(".message-body").textContent = "Message deleted";
+  node.querySelectorAll(".message-action, .reaction-picker, .reactions, .edited-label, .attachment").forEach((el) => el.remove());
+}
+
+function startReply(node, msg) {
+  const id = Number(node.dataset.id); // set once the server has acknowledged our own messages
+  if (!id) return;
+  const content = node.querySelector(".message-body").textContent.replace(/^🔒 /, "");
+  replyingTo = { id, peer: selectedUserId, from: msg.from, content: content.slice(0, 120) };
+
+  const bar = document.getElementById("replyBar");
+  bar.querySelector("span").textContent = `Replying to ${quoteText(replyingTo)}`;
+  bar.style.display = "flex";
+  document.getElementById("chatInput").focus();
+}
+
+function clearReply() {
+  replyingTo = null;
+  const bar = document.getElementById("replyBar");
+  if (bar) bar.style.display = "none";
+}
+
+function showTimer(seconds) {
+  const select = document.getElementById("timerSelect");
+  if (!select) return;
+  if (![...select.options].some((o) => o.value == seconds)) {
+    select.add(new Option(`${Math.round(seconds / 60)} min`, seconds));
+  }
+  select.value = seconds;
+}
+
+function loadTimer(userId) {
+  fetch(`/conversations/timer?with=${userId}`, { credentials: "include" })
+    .then((res) => (res.ok ? res.json() : { seconds: 0 }))
+    .then((data) => {
+      if (userId === selectedUserId) showTimer(data.seconds);
+    })
+    .catch((err) => console.error("Could not load message timer:", err));
+}
+
+function setupTimerSelect() {
+  const select = document.getElementById("timerSelect");
+  if (!select) return;
+  select.onchange = () => {
+    if (!selectedUserId) return;
+    fetch("/conversations/timer", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      credentials: "include",
+      body: JSON.stringify({ user_id: selectedUserId, seconds: Number(select.value) }),
+    })
+      .then((res) => {
+        if (!res.ok) throw new Error(`status ${res.status}`);
+        return res.json();
+      })
+      .then((data) => showTimer(data.seconds))
+      .catch((err) => {
+        console.error("Could not change message timer:", err);
+        loadTimer(selectedUserId);
+      });
+  };
+}
+
+// updateUserList adds (POST) or removes (DELETE) a user on our /blocks or /mutes list and
+// resolves to the new list.
+function updateUserList(path, method, userId) {
+  const request =
+    method === "POST"
+      ? { method, headers: { "Content-Type": "application/json" }, body: JSON.stringify({ user_id: userId }) }
+      : { method };
+  const url = method === "POST" ? path : `${path}?user_id=${userId}`;
+  return fetch(url, { ...request, credentials: "include" }).then((res) => {
+    if (!res.ok) throw new Error(`status ${res.status}`);
+    return res.json();
+  });
+}
+
+function showMuted(muted) {
+  const button = document.getElementById("muteToggle");
+  button.dataset.muted = muted ? "1" : "";
+  button.textContent = muted ? "🔕 Muted" : "🔔 Mute";
+  button.title = muted ? "Messages arrive without notifications; click to unmute" : "Stop notifications for this conversation";
+}
+
+function loadMuted(userId) {
+  fetch("/mutes", { credentials: "include" })
+    .then((res) => (res.ok ? res.json() : []))
+    .then((muted) => {
+      if (userId === selectedUserId) showMuted(muted.some((m) => m.user_id === userId));
+    })
+    .catch((err) => console.error("Could not load muted conversations:", err));
+}
+
+// Lists the users we blocked, each with a button to unblock them.
+function renderBlockedUsers(blocked) {
+  const list = document.querySelector("#blockedUsers ul");
+  list.replaceChildren();
+  blocked.forEach((user) => {
+    const li = document.createElement("li");
+    li.textContent = user.username;
+    const unblock = document.createElement("button");
+    unblock.type = "button";
+    unblock.classList.add("message-action");
+    unblock.textContent = "Unblock";
+    unblock.onclick = () =>
+      updateUserList("/blocks", "DELETE", user.user_id)
+        .then((users) => {
+          renderBlockedUsers(users);
+          fetchUserList();
+        })
+        .catch((err) => console.error("Could not unblock user:", err));
+    li.appendChild(unblock);
+    list.appendChild(li);
+  });
+  document.getElementById("blockedUsers").hidden = blocked.length === 0;
+}
+
+function setupBlockAndMute() {
+  const muteButton = document.getElementById("muteToggle");
+  const blockButton = document.getElementById("blockUser");
+  if (!muteButton || !blockButton) return;
+
+  muteButton.onclick = () => {
+    if (!selectedUserId) return;
+    const userId = selectedUserId;
+    const muted = !!muteButton.dataset.muted;
+    updateUserList("/mutes", muted ? "DELETE" : "POST", userId)
+      .then((users) => {
+        if (userId === selectedUserId) showMuted(users.some((m) => m.user_id === userId));
+      })
+      .catch((err) => console.error("Could not change mute setting:", err));
+  };
+
+  blockButton.onclick = () => {
+    if (!selectedUserId || !confirm(`Block ${Theirname}? Neither of you will be able to message the other.`)) return;
+    updateUserList("/blocks", "POST", selectedUserId)
+      .then((users) => {
+        renderBlockedUsers(users);
+        fetchUserList(); // Blocked users are hidden from the list
+        selectedUserId = null;
+        returnToPosts();
+      })
+      .catch((err) => console.error("Could not block user:", err));
+  };
+
+  fetch("/blocks", { credentials: "include" })
+    .then((res) => (res.ok ? res.json() : []))
+    .then(renderBlockedUsers)
+    .catch((err) => console.error("Could not load blocked users:", err));
+}
+
+// Downloads the open conversation as a self-contained HTML transcript in our time zone.
+function exportConversation() {
+  if (!selectedUserId) return;
+  const params = new URLSearchParams({
+    with: selectedUserId,
+    format: "html",
+    tz: Intl.DateTimeFormat().resolvedOptions().timeZone || "UTC",
+  });
+  window.location.href = `/messages/export?${params}`;
+}
+
+// Searches the user's direct messages; picking a result opens the conversation at that message.
+function setupSearch() {
+  const form = document.getElementById("searchForm");
+  if (!form) return;
+  const input = document.getElementById("searchInput");
+  const results = document.getElementById("searchResults");
+
+  form.addEventListener("submit", (e) => {
+    e.preventDefault();
+    const text = input.value.trim();
+    results.replaceChildren();
+    if (!text) return;
+    fetch(`/messages/search?${new URLSearchParams({ q: text })}`, { credentials: "include" })
+      .then((res) => (res.ok ? res.json() : []))
+      .then((matches) => {
+        if (matches.length === 0) {
+          const empty = document.createElement("li");
+          empty.classList.add("search-empty");
+          empty.textContent = "No messages found";
+          results.appendChild(empty);
+          return;
+        }
+        matches.forEach((match) => results.appendChild(searchResultItem(match)));
+      })
+      .catch((err) => console.error("Search failed:", err));
+  });
+  input.addEventListener("search", () => {
+    if (!input.value) results.replaceChildren(); // The field's clear button
+  });
+}
+
+function searchResultItem(match) {
+  const peer = document.querySelector(`#userList li[data-user-id="${match.peer_id}"] span`);
+  const username = peer ? peer.textContent : `User ${match.peer_id}`;
+  const li = document.createElement("li");
+  li.classList.add("search-result");
+
+  const title = document.createElement("strong");
+  title.textContent = `${username} · ${new Date(match.timestamp).toLocaleDateString()}`;
+  const snippet = document.createElement("div");
+  snippet.innerHTML = match.snippet; // Escaped by the server, matches in <mark>
+  li.append(title, snippet);
+  li.onclick = () => jumpToMessage(match.peer_id, username, match.id);
+  return li;
+}
+
+// Opens the conversation and pages back through history until the message is loaded.
+async function jumpToMessage(peerId, username, messageId) {
+  await openChatWith(peerId, username);
+  const find = () => document.querySelector(`#chatWindow .chat-message[data-id="${messageId}"]`);
+  let cursor = null;
+  while (!find() && nextCursor && nextCursor !== cursor && selectedUserId === peerId) {
+    cursor = nextCursor; // Stops if a page fails to load
+    await loadMessages(peerId, cursor);
+  }
+  const node = find();
+  if (!node) return;
+  node.scrollIntoView({ block: "center" });
+  node.classList.add("search-hit");
+  setTimeout(() => node.classList.remove("search-hit"), 2000);
 }
 
 function setupChatForm() {
   const chatForm = document.getElementById("chatForm");
   const chatInput = document.getElementById("chatInput");
 
-  chatForm.addEventListener("submit", (e) => {
+  const fileInput = document.getElementById("attachmentInput");
+
+  chatForm.addEventListener("submit", async (e) => {
     e.preventDefault(); // Prevents page reload
     const content = chatInput.value.trim();
-    if (content && selectedUserId) {
+    const file = fileInput.files[0];
+    if (selectedRoomId) {
+      if (file) {
+        appendSystemMessage("Files cannot be sent to rooms.");
+        return;
+      }
+      if (content) sendRoomMessage(selectedRoomId, content);
+      chatInput.value = "";
+      return;
+    }
+    if (!selectedUserId || (!content && !file)) return;
+    if (!file) {
       sendMessage(selectedUserId, content);
       chatInput.value = ""; // Clear input after sending
+      return;
+    }
+
+    const toId = selectedUserId;
+    if (await encryptionKeyFor(toId).catch(() => true)) {
+      appendSystemMessage("Files cannot be sent in end-to-end encrypted conversations.");
+      return;
+    }
+    try {
+      const attachment = await uploadAttachment(file);
+      sendMessage(toId, content, attachment);
+      chatInput.value = "";
+      fileInput.value = "";
+      showChosenFile();
+    } catch (err) {
+      appendSystemMessage(err.message);
     }
   });
 
+  fileInput.addEventListener("change", showChosenFile);
+  document.getElementById("attachButton").onclick = () => fileInput.click();
+
   chatInput.addEventListener("input", () => {
     sendTypingSignal();
   });
 }
 
-function updateUserListPeriodically() {
-  if (isErrorState) {
-    console.warn("Cannot send data; application is in an error state.");
-    return; // Exit if in error state
+function showChosenFile() {
+  const file = document.getElementById("attachmentInput").files[0];
+  const button = document.getElementById("attachButton");
+  button.textContent = file ? `📎 ${file.name}` : "📎";
+  button.title = file ? "Change the attached file" : "Attach a file";
+}
+
+// Uploads a file ahead of the message that carries it; resolves to its metadata.
+async function uploadAttachment(file) {
+  const body = new FormData();
+  body.append("file", file);
+  const res = await fetch("/attachments", { method: "POST", credentials: "include", body });
+  if (!res.ok) {
+    const reason = (await res.text()).trim();
+    throw new Error(`${file.name} could not be attached: ${reason || res.status}`);
   }
+  return res.json();
+}
 
-  setInterval(() => {
-    fetchUserList(); // Fetch the updated user list
-  }, 300); // Update every 5 seconds (adjust as needed)
+// Shows an image attachment inline and anything else as a download link.
+function renderAttachment(node, attachment) {
+  const link = document.createElement("a");
+  link.classList.add("attachment");
+  link.href = attachment.url;
+  link.target = "_blank";
+  link.rel = "noopener";
+  if (attachment.mime_type.startsWith("image/")) {
+    const image = document.createElement("img");
+    image.src = attachment.url;
+    image.alt = attachment.filename;
+    link.appendChild(image);
+  } else {
+    link.textContent = `📎 ${attachment.filename} (${Math.ceil(attachment.size / 1024)} KB)`;
+  }
+  node.querySelector(".message-body").after(link);
 }
 
 function disconnectWeb() {
+  closingOnPurpose = true;
   socket.close();
   console.log("Socket closed.");
 }
@@ -121,7 +121,6 @@ function loadCommentsForPost(postId) {
                             console.log(" Error: " + data.message);
                         }
                         console.log(" Comment ID:", data.comment_id);
-                        socket.send(JSON.stringify({ type: "new_comment" , post_id: parseInt(postID) , comment_id: data.comment_id}));
 
                     })
                     .catch(error => errorPage(500));
@@ -0,0 +1,175 @@
+// e2e.js - opt-in end-to-end encryption for direct messages.
+//
+// Each user registers an ECDH P-256 public key with the server. Both sides of a conversation
+// derive the same AES-GCM key from their own private key and the other's public key, so the
+// server only ever sees ciphertext plus the IDs of the two keys used. Private keys never leave
+// this browser; they are kept in localStorage, including rotated ones so old messages still open.
+
+const E2E_ALGORITHM = "ECDH-P256";
+const peerKeyCache = new Map(); // user ID -> Promise of that user's keys from /keys
+
+function e2eStorageKey() {
+  return `e2e:${loggedInUserId}`;
+}
+
+function loadKeyring() {
+  try {
+    return JSON.parse(localStorage.getItem(e2eStorageKey())) || { enabled: false, current: null, keys: {} };
+  } catch {
+    return { enabled: false, current: null, keys: {} };
+  }
+}
+
+function saveKeyring(keyring) {
+  localStorage.setItem(e2eStorageKey(), JSON.stringify(keyring));
+}
+
+function e2eEnabled() {
+  const keyring = loadKeyring();
+  return keyring.enabled && !!keyring.current;
+}
+
+function toBase64(buffer) {
+  return btoa(String.fromCharCode(...new Uint8Array(buffer)));
+}
+
+function fromBase64(text) {
+  return Uint8Array.from(atob(text), (c) => c.charCodeAt(0));
+}
+
+// Creates a new key pair and registers it, revoking the previous one on the server.
+async function rotateEncryptionKey() {
+  const pair = await crypto.subtle.generateKey({ name: "ECDH", namedCurve: "P-256" }, true, ["deriveKey"]);
+  const publicKey = toBase64(await crypto.subtle.exportKey("raw", pair.publicKey));
+  const privateJwk = await crypto.subtle.exportKey("jwk", pair.privateKey);
+
+  const res = await fetch("/keys/rotate", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    credentials: "include",
+    body: JSON.stringify({ algorithm: E2E_ALGORITHM, public_key: publicKey }),
+  });
+  if (!res.ok) throw new Error(`Key registration failed: ${res.status}`);
+  const key = await res.json();
+
+  const keyring = loadKeyring();
+  keyring.keys[key.key_id] = privateJwk;
+  keyring.current = key.key_id;
+  keyring.enabled = true;
+  saveKeyring(keyring);
+  return key;
+}
+
+async function setEncryptionEnabled(enabled) {
+  const keyring = loadKeyring();
+  if (enabled && !keyring.current) {
+    await rotateEncryptionKey();
+    return;
+  }
+  keyring.enabled = enabled;
+  saveKeyring(keyring);
+}
+
+function peerKeys(userId, refresh = false) {
+  if (refresh || !peerKeyCache.has(userId)) {
+    peerKeyCache.set(
+      userId,
+      fetch(`/keys?user_id=${userId}`, { credentials: "include" }).then((res) => (res.ok ? res.json() : []))
+    );
+  }
+  return peerKeyCache.get(userId);
+}
+
+async function conversationKey(privateJwk, peerPublicKey) {
+  const privateKey = await crypto.subtle.importKey("jwk", privateJwk, { name: "ECDH", namedCurve: "P-256" }, false, ["deriveKey"]);
+  const publicKey = await crypto.subtle.importKey("raw", fromBase64(peerPublicKey), { name: "ECDH", namedCurve: "P-256" }, false, []);
+  return crypto.subtle.deriveKey(
+    { name: "ECDH", public: publicKey },
+    privateKey,
+    { name: "AES-GCM", length: 256 },
+    false,
+    ["encrypt", "decrypt"]
+  );
+}
+
+// Returns the key messages to peerId are sealed with, or null when they go out in plaintext.
+async function encryptionKeyFor(peerId) {
+  if (!e2eEnabled()) return null;
+  const peerKey = (await peerKeys(peerId, true)).find((k) => !k.revoked_at && k.algorithm === E2E_ALGORITHM);
+  return peerKey || null;
+}
+
+// Returns the encrypted envelope for a message to peerId, or null when encryption is off
+// or the peer has not registered a key, in which case the message is sent in plaintext.
+async function sealForPeer(peerId, text) {
+  const peerKey = await encryptionKeyFor(peerId);
+  if (!peerKey) return null;
+  const keyring = loadKeyring();
+
+  const key = await conversationKey(keyring.keys[keyring.current], peerKey.public_key);
+  const nonce = crypto.getRandomValues(new Uint8Array(12));
+  const ciphertext = await crypto.subtle.encrypt({ name: "AES-GCM", iv: nonce }, key, new TextEncoder().encode(text));
+  return {
+    encrypted: true,
+    content: toBase64(ciphertext),
+    nonce: toBase64(nonce),
+    sender_key_id: keyring.current,
+    recipient_key_id: peerKey.key_id,
+  };
+}
+
+// Decrypts a stored or live message; resolves to null if this browser lacks the key.
+async function openMessage(msg) {
+  const mine = msg.from === loggedInUserId;
+  const myKeyId = mine ? msg.sender_key_id : msg.recipient_key_id;
+  const peerKeyId = mine ? msg.recipient_key_id : msg.sender_key_id;
+  const peerId = mine ? msg.to : msg.from;
+
+  const privateJwk = loadKeyring().keys[myKeyId];
+  if (!privateJwk) return null;
+  let peerKey = (await peerKeys(peerId)).find((k) => k.key_id === peerKeyId);
+  if (!peerKey) {
+    peerKey = (await peerKeys(peerId, true)).find((k) => k.key_id === peerKeyId);
+  }
+  if (!peerKey) return null;
+
+  try {
+    const key = await conversationKey(privateJwk, peerKey.public_key);
+    const plaintext = await crypto.subtle.decrypt({ name: "AES-GCM", iv: fromBase64(msg.nonce) }, key, fromBase64(msg.content));
+    return new TextDecoder().decode(plaintext);
+  } catch (err) {
+    console.warn("Could not decrypt message", msg.id, err);
+    return null;
+  }
+}
+
+// Fills in the body of a rendered encrypted message once it has been decrypted.
+function showDecrypted(node, msg) {
+  const body = node.querySelector(".message-body");
+  if (!body) return;
+  if (msg.deleted_at) {
+    body.textContent = "";
+    return;
+  }
+  body.textContent = "🔒 …";
+  openMessage(msg).then((text) => {
+    body.textContent = text === null ? "🔒 Encrypted message (key not available on this device)" : `🔒 ${text}`;
+  });
+}
+
+function setupEncryptionToggle() {
+  const button = document.getElementById("e2eToggle");
+  if (!button) return;
+
+  const render = () => {
+    button.textContent = e2eEnabled() ? "🔒 Encrypted" : "🔓 Encrypt";
+    button.title = e2eEnabled()
+      ? "New messages to users with a key are end-to-end encrypted"
+      : "Turn on end-to-end encryption for new messages";
+  };
+  button.onclick = () =>
+    setEncryptionEnabled(!e2eEnabled())
+      .catch((err) => console.error("Could not change encryption setting:", err))
+      .finally(render);
+  render();
+}
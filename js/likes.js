@@ -30,7 +30,6 @@ function likeDislikeComment(commentId, isLike) {
         } else {
             console.log(data.error || "Something went wrong.");
         }
-        socket.send(JSON.stringify({ type: "new_commentLike" , comment_id: parseInt(commentId) , is_like: isLike}));
     })
     .catch(error => errorPage(500));
 }
@@ -66,7 +65,6 @@ function likeDislikePost(postId, isLike) {
         } else {
             console.log(data.error || "Something went wrong.");
         }
-        socket.send(JSON.stringify({ type: "new_postLike" , post_id: parseInt(postId) , is_like: isLike}));
     })
     .catch(error => {
         console.error(' Error:', error);
@@ -0,0 +1,197 @@
+// rooms.js - group chat rooms in the chat page.
+//
+// Rooms are invitation-only: a member invites users, who see the invitation in the sidebar
+// and join from there. A room opens in the same chat window as direct messages; while one is
+// open, selectedRoomId is set and selectedUserId is null.
+
+let selectedRoomId = null;
+const ROOM_HISTORY_SIZE = 50; // messages loaded when a room opens
+
+// Finds a username in the user list; the list has everyone we may talk to.
+function usernameFor(userId) {
+  if (userId === loggedInUserId) return Myusername;
+  const item = document.querySelector(`#userList li[data-user-id="${userId}"] span`);
+  return item ? item.textContent : `User ${userId}`;
+}
+
+// Turns "alice, bob" into user IDs; resolves to null and explains when a name is unknown.
+function userIdsFor(names) {
+  const byName = new Map();
+  document.querySelectorAll("#userList li[data-user-id]").forEach((li) => {
+    byName.set(li.querySelector("span").textContent.toLowerCase(), Number(li.dataset.userId));
+  });
+  const ids = [];
+  for (const name of names.split(",").map((n) => n.trim()).filter(Boolean)) {
+    const id = byName.get(name.toLowerCase());
+    if (!id) {
+      alert(`There is no user called ${name}.`);
+      return null;
+    }
+    ids.push(id);
+  }
+  return ids;
+}
+
+// sendRoomControl sends a create/invite/join/leave frame; errors show up in the chat window.
+function sendRoomControl(frame) {
+  const withId = { ...frame, client_id: newClientId() };
+  pendingChanges.add(withId.client_id);
+  sendFrame(withId);
+}
+
+function fetchRooms() {
+  Promise.all([
+    fetch("/rooms", { credentials: "include" }).then((res) => (res.ok ? res.json() : [])),
+    fetch("/rooms?invites=1", { credentials: "include" }).then((res) => (res.ok ? res.json() : [])),
+  ])
+    .then(([rooms, invites]) => renderRooms(rooms, invites))
+    .catch((err) => console.error("Could not load rooms:", err));
+}
+
+function renderRooms(rooms, invites) {
+  const list = document.getElementById("roomList");
+  const unread = new Set(
+    [...list.querySelectorAll("li.has-new-message")].map((li) => Number(li.dataset.roomId))
+  );
+  list.replaceChildren();
+
+  invites.forEach((room) => {
+    const li = document.createElement("li");
+    li.classList.add("room-invite");
+    li.textContent = `${room.name} (invited by ${usernameFor(room.invited_by)})`;
+    const join = document.createElement("button");
+    join.type = "button";
+    join.classList.add("message-action");
+    join.textContent = "Join";
+    join.onclick = () => sendRoomControl({ type: "join_room", room_id: room.id });
+    li.appendChild(join);
+    list.appendChild(li);
+  });
+
+  rooms.forEach((room) => {
+    const li = document.createElement("li");
+    li.dataset.roomId = room.id;
+    li.classList.add("user-item");
+    if (unread.has(room.id)) li.classList.add("has-new-message");
+    li.textContent = `# ${room.name}`;
+    li.onclick = () => openRoom(room.id, room.name);
+    list.appendChild(li);
+  });
+
+  if (selectedRoomId && !rooms.some((room) => room.id === selectedRoomId)) {
+    leaveRoomView(); // We left, possibly from another tab
+    returnToPosts();
+  }
+}
+
+// Switches the header between direct-message and room controls.
+function leaveRoomView() {
+  selectedRoomId = null;
+  document.getElementById("chatSection").classList.remove("room-mode");
+}
+
+function openRoom(roomId, name) {
+  selectedRoomId = roomId;
+  selectedUserId = null;
+  clearReply();
+  document.getElementById("chatSection").classList.add("room-mode");
+  document.getElementById("chatWindow").innerHTML = "";
+  document.getElementById("chatWithLabel").textContent = `# ${name}`;
+  document.getElementById("chatForm").style.display = "flex";
+  const li = document.querySelector(`#roomList li[data-room-id="${roomId}"]`);
+  if (li) li.classList.remove("has-new-message");
+  showChatSection();
+
+  const params = new URLSearchParams({ room: roomId, limit: ROOM_HISTORY_SIZE });
+  fetch(`/messages?${params}`, { credentials: "include" })
+    .then((res) => (res.ok ? res.json() : { messages: [] }))
+    .then((page) => {
+      if (roomId !== selectedRoomId) return;
+      (page.messages || []).forEach((msg) => {
+        prependRoomMessage(msg);
+        if (msg.id > lastSeenRoomId) lastSeenRoomId = msg.id;
+      });
+      chatWindow.scrollTop = chatWindow.scrollHeight;
+    })
+    .catch((err) => console.error("Could not load room history:", err));
+}
+
+function roomMessageNode(msg) {
+  const node = document.createElement("div");
+  node.classList.add("chat-message", msg.from === loggedInUserId ? "my-message" : "received-message");
+  if (msg.id) node.dataset.id = msg.id;
+  if (msg.client_id) node.dataset.clientId = msg.client_id;
+  if (msg.client_id && pendingMessages.has(msg.client_id)) node.classList.add("pending");
+
+  const header = document.createElement("strong");
+  header.textContent = `${usernameFor(msg.from)} ${new Date(msg.timestamp).toLocaleString()}:`;
+  const body = document.createElement("span");
+  body.classList.add("message-body");
+  body.textContent = msg.content;
+  node.append(header, document.createElement("br"), body);
+  return node;
+}
+
+function appendRoomMessage(msg) {
+  chatWindow.append(roomMessageNode(msg));
+  chatWindow.scrollTop = chatWindow.scrollHeight;
+}
+
+function prependRoomMessage(msg) {
+  chatWindow.insertBefore(roomMessageNode(msg), chatWindow.firstChild);
+}
+
+function sendRoomMessage(roomId, content) {
+  const message = { type: "room_message", client_id: newClientId(), room_id: roomId, content };
+  // Kept until the server acknowledges it, and resent after a reconnect
+  pendingMessages.set(message.client_id, message);
+  sendFrame(message);
+  appendRoomMessage({ ...message, from: loggedInUserId, timestamp: new Date().toISOString() });
+}
+
+// handleRoomFrame takes the room frames off the socket; it reports whether it handled msg.
+function handleRoomFrame(msg) {
+  switch (msg.type) {
+    case "room_message":
+      if (msg.room_id === selectedRoomId) {
+        appendRoomMessage(msg);
+      } else {
+        const li = document.querySelector(`#roomList li[data-room-id="${msg.room_id}"]`);
+        if (li) li.classList.add("has-new-message");
+      }
+      return true;
+    case "room_joined":
+    case "room_left":
+      if (msg.room_id === selectedRoomId && msg.from !== loggedInUserId) {
+        appendSystemMessage(`${usernameFor(msg.from)} ${msg.type === "room_joined" ? "joined" : "left"} the room.`);
+      }
+      fetchRooms();
+      return true;
+    case "room_created":
+    case "room_invited":
+      fetchRooms();
+      return true;
+  }
+  return false;
+}
+
+function setupRooms() {
+  document.getElementById("newRoom").onclick = () => {
+    const name = prompt("Room name");
+    if (!name || !name.trim()) return;
+    const members = userIdsFor(prompt("Invite users (comma-separated usernames)", "") || "");
+    if (members === null) return;
+    sendRoomControl({ type: "create_room", content: name.trim(), members });
+  };
+  document.getElementById("inviteToRoom").onclick = () => {
+    if (!selectedRoomId) return;
+    const members = userIdsFor(prompt("Invite users (comma-separated usernames)", "") || "");
+    if (!members || members.length === 0) return;
+    sendRoomControl({ type: "invite_room", room_id: selectedRoomId, members });
+  };
+  document.getElementById("leaveRoom").onclick = () => {
+    if (!selectedRoomId || !confirm("Leave this room? You will need a new invitation to come back.")) return;
+    sendRoomControl({ type: "leave_room", room_id: selectedRoomId });
+  };
+  fetchRooms();
+}
@@ -0,0 +1,99 @@
+// transport.js - the two ways chat frames travel between the browser and the server.
+//
+// Both return the same small interface: `open`, `send(frame)` (reports whether the frame
+// was taken) and `close()`. Handlers get onOpen(), onFrame(msg) and onClose({ code, opened }),
+// where code follows websocket close codes so callers need not care which one is in use.
+
+function openWebSocketTransport(params, handlers) {
+  const scheme = window.location.protocol === "https:" ? "wss" : "ws";
+  const ws = new WebSocket(`${scheme}://${window.location.host}/ws?${params}`);
+  let opened = false;
+
+  ws.onopen = () => {
+    opened = true;
+    handlers.onOpen();
+  };
+  ws.onmessage = (event) => handlers.onFrame(JSON.parse(event.data));
+  ws.onerror = () => console.log("WebSocket error occurred");
+  ws.onclose = (event) => handlers.onClose({ code: event.code, opened });
+
+  return {
+    get open() {
+      return ws.readyState === WebSocket.OPEN;
+    },
+    send(frame) {
+      if (ws.readyState !== WebSocket.OPEN) return false;
+      ws.send(JSON.stringify(frame));
+      return true;
+    },
+    close() {
+      ws.close();
+    },
+  };
+}
+
+// Server-sent events down, POST /chat/send up. The stream's first event is a hello frame
+// with the conn_id that ties our posts to this stream.
+function openSSETransport(params, handlers) {
+  const source = new EventSource(`/chat/events?${params}`, { withCredentials: true });
+  let connId = null;
+  let closed = false;
+  let outbox = Promise.resolve(); // posts go one at a time so frames keep their order
+
+  const finish = (code) => {
+    if (closed) return;
+    closed = true;
+    source.close();
+    handlers.onClose({ code, opened: connId !== null });
+  };
+
+  source.onmessage = (event) => {
+    const msg = JSON.parse(event.data);
+    if (msg.type === "hello") {
+      connId = msg.conn_id;
+      handlers.onOpen();
+      return;
+    }
+    handlers.onFrame(msg);
+  };
+  source.addEventListener("close", (event) => finish(JSON.parse(event.data).code));
+  // EventSource would retry on its own; the caller's backoff decides instead
+  source.onerror = () => finish(1006);
+
+  return {
+    get open() {
+      return connId !== null && !closed;
+    },
+    send(frame) {
+      if (connId === null || closed) return false;
+      const url = `/chat/send?conn_id=${encodeURIComponent(connId)}`;
+      outbox = outbox
+        .then(() =>
+          fetch(url, {
+            method: "POST",
+            headers: { "Content-Type": "application/json" },
+            credentials: "include",
+            body: JSON.stringify(frame),
+          })
+        )
+        .then((res) => {
+          if (res.ok) return;
+          if (res.status === 401) finish(1008);
+          else if (res.status === 404 || res.status >= 500) finish(1006); // reconnect and resend
+          else {
+            // Refused for good (e.g. a bad origin); fail the frame like an error frame would
+            handlers.onFrame({
+              type: "error",
+              client_id: frame.client_id,
+              error: { code: `http_${res.status}`, message: `The server refused the frame (${res.status}).` },
+            });
+          }
+        })
+        .catch(() => finish(1006));
+      return true;
+    },
+    close() {
+      finish(1000);
+    },
+  };
+}
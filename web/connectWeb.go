@@ -15,6 +15,7 @@ import (
 	"forum/database"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"text/template"
 	"time"
@@ -42,6 +43,13 @@ func ConnectWeb(db *sql.DB) {
 	http.Handle("/style/", http.StripPrefix("/style/", http.FileServer(http.Dir("style/"))))
 	http.Handle("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir("js/"))))
 
+	broker, err := chat.NewBrokerFromEnv(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	chatHub := chat.NewHub(db, broker)
+	go chatHub.Run()
+
 	// Define a handler for all paths (main page and dynamic routes)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		mainPageHandler(w, r, db)
@@ -99,13 +107,13 @@ func ConnectWeb(db *sql.DB) {
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
-		p.CreatePost(db, w, r) //  This is the API to save posts
+		p.CreatePost(db, w, r, chatHub) //  This is the API to save posts
 	})
 
 	// likes
 	likesRepo := likerepo.NewLikesRepository(db)
 	likesService := like.NewLikesService(likesRepo)
-	likesController := like.NewLikesController(*likesService)
+	likesController := like.NewLikesController(*likesService, chatHub)
 
 	http.HandleFunc("/likeDislikePost", func(w http.ResponseWriter, r *http.Request) {
 		likesController.LikeDislikePost(w, r, db)
@@ -151,7 +159,7 @@ func ConnectWeb(db *sql.DB) {
 	})
 
 	http.HandleFunc("/create-comment", func(w http.ResponseWriter, r *http.Request) {
-		p.CreateComment(db, w, r) // Ensure this handles comment creation
+		p.CreateComment(db, w, r, chatHub) // Ensure this handles comment creation
 	})
 
 	http.HandleFunc("/category/", func(w http.ResponseWriter, r *http.Request) {
@@ -176,22 +184,18 @@ func ConnectWeb(db *sql.DB) {
 
 	http.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
 		// Clear the session token cookie
-		cookie := &http.Cookie{
+		http.SetCookie(w, &http.Cookie{
 			Name:     "session_token",
 			Value:    "",
 			Expires:  time.Now().Add(-1 * time.Hour), // Expire immediately
 			HttpOnly: true,
 			Path:     "/",
-		}
-		http.SetCookie(w, cookie)
+		})
 
-		// Invalidate session in the database (optional but recommended)
-		cookie, err := r.Cookie("session_token")
-		cookieINT, _ := strconv.Atoi(cookie.Value)
-		if err == nil {
-			// Call a function to delete the session from the database
-			err := database.DeleteSession(db, cookieINT)
-			if err != nil {
+		// Invalidate session in the database and drop any chat sockets opened with it
+		if cookie, err := r.Cookie("session_token"); err == nil {
+			chatHub.CloseSession(cookie.Value)
+			if err := database.DeleteSessionByToken(db, cookie.Value); err != nil {
 				fmt.Println(" Error deleting session:", err)
 				e.ErrorHandler(w, r, 500)
 			}
@@ -202,13 +206,19 @@ func ConnectWeb(db *sql.DB) {
 		json.NewEncoder(w).Encode(response)
 	})
 
-	chatHub := chat.NewHub(db)
-	go chatHub.Run()
-
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		chat.ServeWs(chatHub, w, r)
 	})
 
+	// Fallback for browsers whose proxies break websocket upgrades
+	http.HandleFunc("/chat/events", func(w http.ResponseWriter, r *http.Request) {
+		chat.ServeSSE(chatHub, w, r)
+	})
+
+	http.HandleFunc("/chat/send", func(w http.ResponseWriter, r *http.Request) {
+		chat.SendHandler(chatHub, w, r)
+	})
+
 	http.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
 		userID, loggedIn := u.ValidateSession(db, r)
 		if !loggedIn {
@@ -216,43 +226,186 @@ func ConnectWeb(db *sql.DB) {
 			return
 		}
 
+		page, err := chat.ParsePageQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if roomIDStr := r.URL.Query().Get("room"); roomIDStr != "" {
+			roomID, err := strconv.Atoi(roomIDStr)
+			if err != nil || roomID <= 0 {
+				e.ErrorHandler(w, r, 404)
+				return
+			}
+			isMember, err := chat.IsRoomMember(db, roomID, userID)
+			if err != nil {
+				e.ErrorHandler(w, r, 500)
+				return
+			}
+			if !isMember {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			history, err := chat.GetRoomHistory(db, roomID, userID, page)
+			if err != nil {
+				e.ErrorHandler(w, r, 500)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(history)
+			return
+		}
+
 		withIDStr := r.URL.Query().Get("with")
-		offsetStr := r.URL.Query().Get("offset")
 		withID, err := strconv.Atoi(withIDStr)
 		if err != nil || withID <= 0 {
 			e.ErrorHandler(w, r, 404)
 			return
 		}
-		offset, _ := strconv.Atoi(offsetStr)
 
-		query := `SELECT sender_id, receiver_id, content, created_at FROM messages
-	          WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)
-	          ORDER BY created_at DESC LIMIT 10 OFFSET ?`
-		rows, err := db.Query(query, userID, withID, withID, userID, offset)
+		history, err := chat.GetDirectHistory(db, userID, withID, page)
 		if err != nil {
 			e.ErrorHandler(w, r, 500)
 			return
 		}
-		defer rows.Close()
 
-		var messages []chat.Frontend
-		for rows.Next() {
-			var m chat.Frontend
-			if err := rows.Scan(&m.From, &m.To, &m.Content, &m.Timestamp); err == nil {
-				messages = append(messages, m)
-			}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(history)
+	})
+
+	http.HandleFunc("/messages/search", func(w http.ResponseWriter, r *http.Request) {
+		userID, loggedIn := u.ValidateSession(db, r)
+		if !loggedIn {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		text := strings.TrimSpace(r.URL.Query().Get("q"))
+		if text == "" {
+			http.Error(w, "Missing search query", http.StatusBadRequest)
+			return
+		}
+		withID, _ := strconv.Atoi(r.URL.Query().Get("with"))
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 || limit > chat.MaxPageSize {
+			limit = chat.DefaultPageSize
 		}
 
+		results, err := chat.SearchMessages(db, userID, withID, text, limit)
+		if err != nil {
+			fmt.Println(" Error searching messages:", err)
+			e.ErrorHandler(w, r, 500)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		if messages == nil {
-			messages = []chat.Frontend{}
+		json.NewEncoder(w).Encode(results)
+	})
+
+	http.HandleFunc("/messages/export", func(w http.ResponseWriter, r *http.Request) {
+		chat.ExportConversation(db, w, r)
+	})
+
+	http.HandleFunc("/admin/chat/stats", func(w http.ResponseWriter, r *http.Request) {
+		chat.AdminStatsHandler(chatHub, w, r)
+	})
+
+	http.HandleFunc("/admin/chat/disconnect", func(w http.ResponseWriter, r *http.Request) {
+		chat.AdminDisconnectHandler(chatHub, w, r)
+	})
+
+	http.HandleFunc("/admin/chat/announce", func(w http.ResponseWriter, r *http.Request) {
+		chat.AdminAnnounceHandler(chatHub, w, r)
+	})
+
+	http.HandleFunc("/attachments", func(w http.ResponseWriter, r *http.Request) {
+		chat.UploadAttachment(db, w, r)
+	})
+
+	http.HandleFunc("/attachments/", func(w http.ResponseWriter, r *http.Request) {
+		chat.ServeAttachment(db, w, r)
+	})
+
+	http.HandleFunc("/messages/unread", func(w http.ResponseWriter, r *http.Request) {
+		userID, loggedIn := u.ValidateSession(db, r)
+		if !loggedIn {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		counts, err := chat.GetUnreadCounts(db, userID)
+		if err != nil {
+			e.ErrorHandler(w, r, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(counts)
+	})
+
+	http.HandleFunc("/conversations", func(w http.ResponseWriter, r *http.Request) {
+		userID, loggedIn := u.ValidateSession(db, r)
+		if !loggedIn {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		conversations, err := chatHub.Conversations(userID)
+		if err != nil {
+			e.ErrorHandler(w, r, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(conversations)
+	})
+
+	http.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		chat.KeysHandler(db, w, r)
+	})
+
+	http.HandleFunc("/keys/rotate", func(w http.ResponseWriter, r *http.Request) {
+		chat.RotateKeyHandler(db, w, r)
+	})
+
+	http.HandleFunc("/blocks", func(w http.ResponseWriter, r *http.Request) {
+		chat.BlocksHandler(db, w, r)
+	})
+
+	http.HandleFunc("/mutes", func(w http.ResponseWriter, r *http.Request) {
+		chat.MutesHandler(db, w, r)
+	})
+
+	http.HandleFunc("/conversations/timer", func(w http.ResponseWriter, r *http.Request) {
+		chat.TimerHandler(chatHub, w, r)
+	})
+
+	http.HandleFunc("/rooms", func(w http.ResponseWriter, r *http.Request) {
+		userID, loggedIn := u.ValidateSession(db, r)
+		if !loggedIn {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
-		json.NewEncoder(w).Encode(messages)
 
+		// ?invites=1 lists the rooms the user has been invited to but not joined yet
+		getRooms := chat.GetRoomsForUser
+		if r.URL.Query().Get("invites") == "1" {
+			getRooms = chat.GetRoomInvites
+		}
+		rooms, err := getRooms(db, userID)
+		if err != nil {
+			e.ErrorHandler(w, r, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rooms)
 	})
 
 	http.HandleFunc("/get-users", func(w http.ResponseWriter, r *http.Request) {
-		_, loggedIn := u.ValidateSession(db, r)
+		viewerID, loggedIn := u.ValidateSession(db, r)
 		if !loggedIn {
 			var empty []map[string]interface{}
 			w.Header().Set("Content-Type", "application/json")
@@ -266,7 +419,13 @@ func ConnectWeb(db *sql.DB) {
 				onlineSet[id] = true
 			}
 
-			rows, err := db.Query(`SELECT id, username FROM users`)
+			hidden, err := chat.HiddenUserIDs(db, viewerID) // Users blocked in either direction
+			if err != nil {
+				e.ErrorHandler(w, r, 500)
+				return
+			}
+
+			rows, err := db.Query(`SELECT id, username, last_seen_at FROM users`)
 			if err != nil {
 				http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
 				e.ErrorHandler(w, r, 500)
@@ -278,12 +437,18 @@ func ConnectWeb(db *sql.DB) {
 			for rows.Next() {
 				var id int
 				var username string
-				if err := rows.Scan(&id, &username); err == nil {
-					users = append(users, map[string]interface{}{
-						"id":       id,
-						"username": username,
-						"online":   onlineSet[id], // ✅ Add online status
-					})
+				var lastSeen sql.NullTime
+				if err := rows.Scan(&id, &username, &lastSeen); err == nil && !hidden[id] {
+					user := map[string]interface{}{
+						"id":        id,
+						"username":  username,
+						"online":    onlineSet[id], // ✅ Add online status
+						"last_seen": nil,
+					}
+					if lastSeen.Valid {
+						user["last_seen"] = lastSeen.Time
+					}
+					users = append(users, user)
 				}
 			}
 
@@ -308,8 +473,12 @@ func ConnectWeb(db *sql.DB) {
 
 	})
 
-	fmt.Println("Listening on: http://localhost:8888/")
-	if err := http.ListenAndServe("0.0.0.0:8888", nil); err != nil {
+	addr := os.Getenv("FORUM_ADDR") // e.g. "0.0.0.0:8889" for a second instance
+	if addr == "" {
+		addr = "0.0.0.0:8888"
+	}
+	fmt.Println("Listening on:", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
 		fmt.Println("Error starting server:", err)
 	}
 }